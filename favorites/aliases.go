@@ -0,0 +1,79 @@
+// Canonicalization of drink names using configurable aliases, such as
+// "OJ Vodka" for "Screwdriver", and restriction to an allow-list of drinks.
+
+package main
+
+import (
+	"os"
+	"strings"
+	"encoding/json"
+)
+
+// ---
+// Parses aliases provided either as a JSON object mapping alias to canonical
+// drink name, or as path to a file containing such an object. Aliases are
+// matched case-insensitively and with surrounding whitespace ignored.
+func parseDrinkAliases(value string) (map[string]string, error) {
+	aliasData := []byte(value)
+
+	if !strings.HasPrefix(strings.TrimSpace(value), "{") {
+		var err error
+		aliasData, err = os.ReadFile(value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var rawAliases map[string]string
+	if err := json.Unmarshal(aliasData, &rawAliases); err != nil {
+		return nil, err
+	}
+
+	aliases := map[string]string{}
+	for alias, drink := range rawAliases {
+		aliases[strings.ToLower(strings.TrimSpace(alias))] = drink
+	}
+
+	return aliases, nil
+}
+
+// ---
+// Returns canonical name of drink, or drink unchanged if it has no alias.
+func canonicalDrink(aliases map[string]string, drink string) string {
+	if canonical, found := aliases[strings.ToLower(strings.TrimSpace(drink))]; found {
+		return canonical
+	}
+
+	return drink
+}
+
+// ---
+// Parses allowed drink names provided either as comma-separated list or as
+// path (starting with "/" or ".") to a file listing one drink per line or
+// separated by commas. Returned names are normalized like aliases.
+func parseAllowedDrinks(value string) (map[string]bool, error) {
+	if strings.HasPrefix(value, "/") || strings.HasPrefix(value, ".") {
+		fileData, err := os.ReadFile(value)
+		if err != nil {
+			return nil, err
+		}
+
+		value = strings.ReplaceAll(string(fileData), "\n", ",")
+	}
+
+	allowedDrinks := map[string]bool{}
+	for _, drink := range strings.Split(value, ",") {
+		if drink = strings.ToLower(strings.TrimSpace(drink)); drink != "" {
+			allowedDrinks[drink] = true
+		}
+	}
+
+	return allowedDrinks, nil
+}
+
+// ---
+// Returns true if drink (after canonicalization) is allowed, which all drinks
+// are if no allow-list is configured.
+func drinkAllowed(allowedDrinks map[string]bool, drink string) bool {
+	return allowedDrinks == nil || allowedDrinks[strings.ToLower(strings.TrimSpace(drink))]
+}
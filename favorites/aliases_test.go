@@ -0,0 +1,72 @@
+// Tests of drink name aliases and allow-lists.
+
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"net/http"
+	"path/filepath"
+)
+
+// ---
+func TestAliasesAreStoredAsCanonicalDrink(t *testing.T) {
+	aliasesPath := filepath.Join(t.TempDir(), "aliases.json")
+	if err := os.WriteFile(aliasesPath, []byte(`{"OJ Vodka": "Screwdriver"}`), 0o600); err != nil {
+		t.Fatalf("Failed to write aliases file: %s", err)
+	}
+
+	for _, aliases := range []string{`{"OJ Vodka": "Screwdriver"}`, aliasesPath} {
+		t.Setenv("APP_DRINK_ALIASES", aliases)
+		store := &fakeStore{}
+		_, handler := newTestHandler(testConfig(t), store)
+
+		for _, drink := range []string{"OJ Vodka", " oj vodka ", "Screwdriver"} {
+			request := newTestRequest("POST", "/api/favorites/ada", `"` + drink + `"`)
+			if response := serve(handler, request); response.Code >= 300 {
+				t.Fatalf("Adding \"%s\" responded with status %d", drink, response.Code)
+			}
+		}
+
+		if rows := store.rows("ada", ""); len(rows) != 1 || rows[0].Drink != "Screwdriver" {
+			t.Errorf(
+				"Expected aliases from %s to be stored as canonical drink, got %+v", aliases, rows)
+		}
+
+		response := serve(handler, newTestRequest("GET", "/api/favorites/ada", ""))
+		if response.Code != http.StatusOK || response.Body.String() != `["Screwdriver"]` {
+			t.Errorf("Expected only canonical drink to be listed, got %s", response.Body)
+		}
+	}
+}
+
+// ---
+func TestOnlyAllowedDrinksAreAdded(t *testing.T) {
+	t.Setenv("APP_ALLOWED_DRINKS", "Negroni, Screwdriver")
+	t.Setenv("APP_DRINK_ALIASES", `{"OJ Vodka": "Screwdriver"}`)
+	store := &fakeStore{}
+	_, handler := newTestHandler(testConfig(t), store)
+
+	cases := map[string]int{
+		"Negroni": http.StatusCreated,
+		"negroni": http.StatusCreated,
+		"OJ Vodka": http.StatusCreated,
+		"Mojito": http.StatusUnprocessableEntity,
+	}
+
+	for drink, expected := range cases {
+		request := newTestRequest("POST", "/api/favorites/ada", `"` + drink + `"`)
+		if response := serve(handler, request); response.Code != expected {
+			t.Errorf("Expected status %d adding \"%s\", got %d", expected, drink, response.Code)
+		} else if expected == http.StatusUnprocessableEntity &&
+			!strings.Contains(response.Body.String(), `"code":"DRINK_NOT_ALLOWED"`) {
+
+			t.Errorf("Expected error code DRINK_NOT_ALLOWED, got %s", response.Body)
+		}
+	}
+
+	if rows := store.rows("ada", "Mojito"); len(rows) != 0 {
+		t.Errorf("Expected disallowed drink not to be stored, got %d favorites", len(rows))
+	}
+}
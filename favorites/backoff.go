@@ -0,0 +1,57 @@
+// Exponential backoff with jitter, used when retrying database operations.
+
+package main
+
+import (
+	"log"
+	"time"
+	"math/rand"
+)
+
+// ---
+// Delays are drawn from random if set (such as for reproducible tests), and
+// from the shared source of math/rand otherwise.
+type backoffPolicy struct {
+	base time.Duration
+	cap time.Duration
+	random *rand.Rand
+}
+
+// ---
+// Returns random delay between zero and the exponential backoff ceiling for
+// attempt (starting at zero), using the "full jitter" approach to prevent many
+// replicas from retrying in lockstep after a shared failure.
+func (policy backoffPolicy) Delay(attempt int) time.Duration {
+	ceiling := policy.cap
+	if attempt < 32 && policy.base << attempt > 0 && policy.base << attempt < policy.cap {
+		ceiling = policy.base << attempt
+	}
+
+	if policy.random != nil {
+		return time.Duration(policy.random.Int63n(int64(ceiling) + 1))
+	}
+
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// ---
+// Calls operation until it succeeds or the maximum number of attempts is
+// reached, sleeping for delays of policy in between. Returns the last error.
+// Sleeping is done using the provided function to allow testing.
+func retryWithBackoff(
+	description string, attempts int, policy backoffPolicy, sleep func(time.Duration),
+	operation func() error) error {
+
+	for attempt := 1; ; attempt++ {
+		err := operation()
+		if err == nil || attempt >= attempts {
+			return err
+		}
+
+		delay := policy.Delay(attempt - 1)
+		log.Printf(
+			"Failed to %s (attempt %d), retrying in %s: %s", description, attempt, delay, err)
+
+		sleep(delay)
+	}
+}
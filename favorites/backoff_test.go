@@ -0,0 +1,95 @@
+// Tests of retrying with exponential backoff.
+
+package main
+
+import (
+	"time"
+	"errors"
+	"testing"
+	"math/rand"
+)
+
+// ---
+func TestStartupRetrySucceedsAfterFailures(t *testing.T) {
+	policy := backoffPolicy{base: 100 * time.Millisecond, cap: 150 * time.Millisecond}
+	var delays []time.Duration
+	attempts := 0
+
+	err := retryWithBackoff(
+		"create table", 10, policy, func(delay time.Duration) {
+			delays = append(delays, delay)
+		},
+		func() error {
+			attempts++
+			if attempts < 3 {
+				return errors.New("connection refused")
+			}
+
+			return nil
+		})
+
+	if err != nil || attempts != 3 {
+		t.Fatalf("Expected success on attempt 3, got %d attempt(s) and error: %v", attempts, err)
+	}
+
+	ceilings := []time.Duration{100 * time.Millisecond, 150 * time.Millisecond}
+	if len(delays) != len(ceilings) {
+		t.Fatalf("Expected %d delays, got %v", len(ceilings), delays)
+	}
+
+	for index, delay := range delays {
+		if delay < 0 || delay > ceilings[index] {
+			t.Errorf("Expected delay %d within [0, %s], got %s", index, ceilings[index], delay)
+		}
+	}
+}
+
+// ---
+func TestStartupRetryGivesUpAfterMaximumAttempts(t *testing.T) {
+	attempts := 0
+	err := retryWithBackoff(
+		"create table", 3, backoffPolicy{base: 1, cap: 1}, func(time.Duration) {},
+		func() error {
+			attempts++
+			return errors.New("connection refused")
+		})
+
+	if err == nil || attempts != 3 {
+		t.Errorf(
+			"Expected failure after 3 attempts, got %d attempt(s) and error: %v", attempts, err)
+	}
+}
+
+// ---
+func TestBackoffDelaysAreWithinBounds(t *testing.T) {
+	policy := backoffPolicy{
+		base: 100 * time.Millisecond, cap: time.Second, random: rand.New(rand.NewSource(1))}
+
+	ceilings := map[int]time.Duration{
+		0: 100 * time.Millisecond, 1: 200 * time.Millisecond, 3: 800 * time.Millisecond,
+		4: time.Second, 100: time.Second}
+
+	for attempt, ceiling := range ceilings {
+		for sample := 0; sample < 1000; sample++ {
+			if delay := policy.Delay(attempt); delay < 0 || delay > ceiling {
+				t.Fatalf(
+					"Expected delay of attempt %d within [0, %s], got %s", attempt, ceiling, delay)
+			}
+		}
+	}
+}
+
+// ---
+func TestBackoffDelaysAreReproducibleWithSeed(t *testing.T) {
+	newPolicy := func() backoffPolicy {
+		return backoffPolicy{
+			base: time.Millisecond, cap: time.Second, random: rand.New(rand.NewSource(42))}
+	}
+
+	first, second := newPolicy(), newPolicy()
+	for attempt := 0; attempt < 10; attempt++ {
+		if first.Delay(attempt) != second.Delay(attempt) {
+			t.Fatalf("Expected equally seeded policies to agree on delay of attempt %d", attempt)
+		}
+	}
+}
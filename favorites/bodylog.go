@@ -0,0 +1,109 @@
+// Middleware logging request and response bodies for debugging of clients.
+
+package main
+
+import (
+	"io"
+	"log"
+	"strings"
+	"net/http"
+)
+
+// Headers whose values are redacted in logged requests.
+var sensitiveHeaders = []string{"X-Access-Key", "X-Admin-Key", "Authorization", "Cookie"}
+
+// ---
+// Captures up to limit bytes of data passing through it.
+type bodyCapture struct {
+	limit int
+	data []byte
+	truncated bool
+}
+
+// ---
+func (capture *bodyCapture) capture(data []byte) {
+	remaining := capture.limit - len(capture.data)
+	if len(data) > remaining {
+		data = data[:remaining]
+		capture.truncated = true
+	}
+
+	capture.data = append(capture.data, data...)
+}
+
+// ---
+func (capture *bodyCapture) String() string {
+	if capture.truncated {
+		return string(capture.data) + "[truncated]"
+	}
+
+	return string(capture.data)
+}
+
+// ---
+// Wraps request body to capture data read from it by the handler.
+type capturingReader struct {
+	io.ReadCloser
+	*bodyCapture
+}
+
+// ---
+func (reader *capturingReader) Read(data []byte) (int, error) {
+	count, err := reader.ReadCloser.Read(data)
+	reader.capture(data[:count])
+	return count, err
+}
+
+// ---
+// Wraps response writer to capture the response body.
+type capturingWriter struct {
+	http.ResponseWriter
+	*bodyCapture
+}
+
+// ---
+func (writer *capturingWriter) Write(data []byte) (int, error) {
+	writer.capture(data)
+	return writer.ResponseWriter.Write(data)
+}
+
+// ---
+func (writer *capturingWriter) Unwrap() http.ResponseWriter {
+	return writer.ResponseWriter
+}
+
+// ---
+// Returns handler logging headers and bodies of requests and responses,
+// truncated to limit bytes. Values of access keys are redacted, wherever
+// they occur, but bodies may still contain personal information.
+func withBodyLogging(handler http.Handler, limit int, secrets []string) http.Handler {
+	replacements := []string{}
+	for _, secret := range secrets {
+		if secret != "" {
+			replacements = append(replacements, secret, "****")
+		}
+	}
+
+	redactor := strings.NewReplacer(replacements...)
+
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		requestCapture := &bodyCapture{limit: limit}
+		request.Body = &capturingReader{request.Body, requestCapture}
+
+		responseCapture := &bodyCapture{limit: limit}
+		handler.ServeHTTP(&capturingWriter{response, responseCapture}, request)
+
+		headers := request.Header.Clone()
+		for _, name := range sensitiveHeaders {
+			if headers.Get(name) != "" {
+				headers.Set(name, "****")
+			}
+		}
+
+		log.Printf(
+			"DEBUG: Request \"%s %s\" with headers %v and body \"%s\", response body \"%s\"",
+			request.Method, redactor.Replace(request.URL.RequestURI()), headers,
+			redactor.Replace(requestCapture.String()),
+			redactor.Replace(responseCapture.String()))
+	})
+}
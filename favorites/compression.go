@@ -0,0 +1,208 @@
+// Compression of response bodies using an algorithm negotiated with clients
+// using the "Accept-Encoding" header, and decompression of request bodies.
+
+package main
+
+import (
+	"io"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"net/http"
+	"compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Supported compression algorithms, by content coding name.
+var compressionAlgorithms = map[string]func(io.Writer) io.WriteCloser{
+	"gzip": func(writer io.Writer) io.WriteCloser {
+		return gzip.NewWriter(writer)
+	},
+	"zstd": func(writer io.Writer) io.WriteCloser {
+		// Errors are only returned for invalid options
+		encoder, _ := zstd.NewWriter(writer, zstd.WithEncoderConcurrency(1))
+		return encoder
+	},
+}
+
+// ---
+// Returns enabled algorithm with the highest preference ("q" value) in
+// "Accept-Encoding" header value, or an empty string if none is acceptable.
+// Ties are broken by order of enabled algorithms.
+func negotiateEncoding(acceptEncoding string, algorithms []string) string {
+	preferences := map[string]float64{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, parameters, _ := strings.Cut(part, ";")
+		preference := 1.0
+
+		if value, found := strings.CutPrefix(strings.TrimSpace(parameters), "q="); found {
+			parsedValue, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+
+			preference = parsedValue
+		}
+
+		preferences[strings.ToLower(strings.TrimSpace(name))] = preference
+	}
+
+	selected, selectedPreference := "", 0.0
+	for _, algorithm := range algorithms {
+		preference, found := preferences[algorithm]
+		if !found {
+			preference = preferences["*"]
+		}
+
+		if preference > selectedPreference {
+			selected, selectedPreference = algorithm, preference
+		}
+	}
+
+	return selected
+}
+
+// ---
+// Wraps response writer to compress body upon first write, leaving responses
+// without body (such as those with status 204) untouched.
+type compressingWriter struct {
+	http.ResponseWriter
+	algorithm string
+	status int
+	started bool
+	encoder io.WriteCloser
+}
+
+// ---
+func (writer *compressingWriter) WriteHeader(status int) {
+	if writer.status == 0 {
+		writer.status = status
+	}
+}
+
+// ---
+func (writer *compressingWriter) Write(data []byte) (int, error) {
+	if !writer.started {
+		writer.started = true
+
+		header := writer.Header()
+		if header.Get("Content-Type") == "" {
+			header.Set("Content-Type", http.DetectContentType(data))
+		}
+
+		// Responses already encoded by handlers are passed through as is
+		if header.Get("Content-Encoding") == "" {
+			header.Set("Content-Encoding", writer.algorithm)
+			header.Del("Content-Length")
+			writer.encoder = compressionAlgorithms[writer.algorithm](writer.ResponseWriter)
+		}
+
+		writer.ResponseWriter.WriteHeader(max(writer.status, http.StatusOK))
+	}
+
+	if writer.encoder == nil {
+		return writer.ResponseWriter.Write(data)
+	}
+
+	return writer.encoder.Write(data)
+}
+
+// ---
+// Flushes compressed body or, if nothing was written, the status code.
+func (writer *compressingWriter) Close() error {
+	if writer.encoder != nil {
+		return writer.encoder.Close()
+	}
+
+	if !writer.started && writer.status != 0 {
+		writer.ResponseWriter.WriteHeader(writer.status)
+	}
+
+	return nil
+}
+
+// ---
+func (writer *compressingWriter) Unwrap() http.ResponseWriter {
+	return writer.ResponseWriter
+}
+
+// ---
+// Returns handler compressing responses using the enabled algorithm preferred
+// by the client, or leaving them uncompressed if none is acceptable.
+func withCompression(handler http.Handler, algorithms []string) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Add("Vary", "Accept-Encoding")
+
+		algorithm := negotiateEncoding(request.Header.Get("Accept-Encoding"), algorithms)
+		if algorithm == "" {
+			handler.ServeHTTP(response, request)
+			return
+		}
+
+		writer := &compressingWriter{ResponseWriter: response, algorithm: algorithm}
+		defer writer.Close()
+
+		handler.ServeHTTP(writer, request)
+	})
+}
+
+// ---
+// Wraps gzip reader to close the underlying body as well.
+type gzipBody struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+// ---
+func (body *gzipBody) Close() error {
+	body.Reader.Close()
+	return body.body.Close()
+}
+
+// ---
+// Returns handler transparently decompressing gzip-encoded request bodies and
+// limiting the size of all bodies to maxBytes. For compressed bodies the limit
+// applies to the decompressed size, protecting against "zip bombs".
+func withRequestDecompression(handler http.Handler, maxBytes int64) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		switch strings.ToLower(request.Header.Get("Content-Encoding")) {
+		case "", "identity":
+		case "gzip":
+			gzipReader, err := gzip.NewReader(request.Body)
+			if err != nil {
+				log.Print("Received request with malformed gzip body: ", err)
+				writeError(response, errorInvalidBody, "Malformed gzip body")
+				return
+			}
+
+			request.Body = &gzipBody{Reader: gzipReader, body: request.Body}
+			request.Header.Del("Content-Encoding")
+			request.Header.Del("Content-Length")
+			request.ContentLength = -1
+		default:
+			log.Printf(
+				"Received request with unsupported content encoding \"%s\"",
+				request.Header.Get("Content-Encoding"))
+
+			writeError(response, errorUnsupportedEncoding, "Unsupported content encoding")
+			return
+		}
+
+		request.Body = http.MaxBytesReader(response, request.Body, maxBytes)
+		handler.ServeHTTP(response, request)
+	})
+}
+
+// ---
+// Responds to failure to read request body, with status 413 if it exceeded the
+// size limit set by withRequestDecompression.
+func writeBodyReadError(response http.ResponseWriter, err error) {
+	var maxBytesError *http.MaxBytesError
+	if errors.As(err, &maxBytesError) {
+		writeError(response, errorBodyTooLarge, "Submitted body is too large")
+		return
+	}
+
+	writeError(response, errorInvalidBody, "Failed to read submitted body")
+}
@@ -0,0 +1,66 @@
+// Tests of compression of responses and decompression of requests.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"net/http"
+	"compress/gzip"
+)
+
+// ---
+// Returns request with valid access key and gzip-compressed body.
+func newGzipTestRequest(method string, path string, body string) *http.Request {
+	buffer := &bytes.Buffer{}
+	writer := gzip.NewWriter(buffer)
+	writer.Write([]byte(body))
+	writer.Close()
+
+	request := newTestRequest(method, path, buffer.String())
+	request.Header.Set("Content-Encoding", "gzip")
+	return request
+}
+
+// ---
+func TestGzipRequestBodiesAreDecompressed(t *testing.T) {
+	store := &fakeStore{}
+	_, handler := newTestHandler(testConfig(t), store)
+
+	response := serve(handler, newGzipTestRequest("POST", "/api/favorites/ada", `"Negroni"`))
+	if response.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", response.Code, response.Body)
+	}
+
+	if rows := store.rows("ada", "Negroni"); len(rows) != 1 {
+		t.Errorf("Expected decompressed favorite to be stored, got %d favorites", len(rows))
+	}
+}
+
+// ---
+func TestDecompressedBodySizeIsLimited(t *testing.T) {
+	t.Setenv("APP_MAX_BODY_BYTES", "4096")
+	store := &fakeStore{}
+	_, handler := newTestHandler(testConfig(t), store)
+
+	// Decompresses to 256 times the limit
+	body := `{"drink":"Negroni","category":"` + strings.Repeat("a", 1 << 20) + `"}`
+	request := newGzipTestRequest("POST", "/api/favorites/ada", body)
+	if request.ContentLength >= 4096 {
+		t.Fatalf("Compressed body of %d bytes isn't below limit", request.ContentLength)
+	}
+
+	response := serve(handler, request)
+	if response.Code != http.StatusRequestEntityTooLarge ||
+		!strings.Contains(response.Body.String(), `"code":"BODY_TOO_LARGE"`) {
+
+		t.Errorf(
+			"Expected status 413 with code BODY_TOO_LARGE, got %d: %s",
+			response.Code, response.Body)
+	}
+
+	if rows := store.rows("", ""); len(rows) != 0 {
+		t.Errorf("Expected oversized favorite not to be stored, got %d favorites", len(rows))
+	}
+}
@@ -0,0 +1,414 @@
+// Loading and validation of settings provided using environment variables,
+// documented in main.go.
+
+package main
+
+import (
+	"os"
+	"fmt"
+	"time"
+	"strings"
+	"strconv"
+	"net/url"
+	"net/http"
+	"net/netip"
+)
+
+// Time window (start inclusive, end exclusive) during which writes are disabled.
+type maintenanceWindow struct {
+	Start time.Time
+	End time.Time
+}
+
+type Config struct {
+	AccessKey string
+	ReadOnlyAccessKey string
+	AdminKey string
+	DefaultUser string
+	ShareSecret string
+	ShareTTL time.Duration
+	BackfillMaxSkew time.Duration
+	DatabaseURL string
+	DatabaseReadURL string
+	DatabaseShadowURL string
+	DatabaseHeaders http.Header
+	DatabaseTimeout time.Duration
+	DatabaseMaxTimeout time.Duration
+	DatabaseWriteAttempts int
+	QueuedWrites bool
+	DatabaseStartupAttempts int
+	BackoffBase time.Duration
+	BackoffCap time.Duration
+	SlowQueryThreshold time.Duration
+	HealthQuery string
+	CaseInsensitiveUsers bool
+	RecipesURL string
+	SeedData bool
+	WarmupQueries int
+	DedupWindow time.Duration
+	IDsAsStrings bool
+	DrinkAliases map[string]string
+	AllowedDrinks map[string]bool
+	AutocompleteMax int
+	MaxPaginationOffset int
+	MetricsDrinks []string
+	MetricsMaxDrinks int
+	EnableDebug bool
+	DebugLogBodies bool
+	DebugLogBodyLimit int
+	MaxHeaderBytes int
+	MaxBodyBytes int
+	RequestTimeout time.Duration
+	MaintenanceWindows []maintenanceWindow
+	AdminAddress string
+	PathPrefix string
+	TrailingSlash string
+	MaxConnectionsPerIP int
+	TrustedProxies []netip.Prefix
+	EnableH2C bool
+	Compression []string
+}
+
+// ---
+// Reads environment variables while collecting all problems encountered,
+// enabling them to be reported at once instead of one at a time.
+type configLoader struct {
+	problems []string
+}
+
+// ---
+func (loader *configLoader) addProblem(format string, arguments ...interface{}) {
+	loader.problems = append(loader.problems, fmt.Sprintf(format, arguments...))
+}
+
+// ---
+func (loader *configLoader) required(name string) string {
+	value := os.Getenv(name)
+	if value == "" {
+		loader.addProblem("Environment variable %s is missing", name)
+	}
+
+	return value
+}
+
+// ---
+func (loader *configLoader) duration(name string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 {
+		loader.addProblem(
+			"Environment variable %s must be a non-negative duration: \"%s\"", name, value)
+
+		return defaultValue
+	}
+
+	return duration
+}
+
+// ---
+func (loader *configLoader) integer(name string, defaultValue int, minimum int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+
+	parsedValue, err := strconv.Atoi(value)
+	if err != nil || parsedValue < minimum {
+		loader.addProblem(
+			"Environment variable %s must be an integer of at least %d: \"%s\"",
+			name, minimum, value)
+
+		return defaultValue
+	}
+
+	return parsedValue
+}
+
+// ---
+func (loader *configLoader) boolean(name string) bool {
+	value := os.Getenv(name)
+	if value == "" {
+		return false
+	}
+
+	parsedValue, err := strconv.ParseBool(value)
+	if err != nil {
+		loader.addProblem("Environment variable %s must be \"true\" or \"false\": \"%s\"", name, value)
+		return false
+	}
+
+	return parsedValue
+}
+
+// ---
+// Returns parsed HTTP/HTTPS URL, or nil if value is empty or invalid.
+func (loader *configLoader) httpURL(name string, value string) *url.URL {
+	if value == "" {
+		return nil
+	}
+
+	parsedURL, err := url.Parse(value)
+	if err != nil || (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") {
+		loader.addProblem(
+			"Environment variable %s must be a HTTP or HTTPS URL: \"%s\"", name, redactURL(value))
+
+		return nil
+	}
+
+	return parsedURL
+}
+
+// ---
+// Returns database URL with credentials from dedicated environment variables
+// (credentialsPrefix followed by "_USER" and "_PASSWORD") added, if both are set.
+func (loader *configLoader) databaseURL(
+	name string, value string, credentialsPrefix string) string {
+
+	parsedURL := loader.httpURL(name, value)
+
+	databaseUser := os.Getenv(credentialsPrefix + "_USER")
+	databasePassword := os.Getenv(credentialsPrefix + "_PASSWORD")
+	if parsedURL == nil || databaseUser == "" || databasePassword == "" {
+		return value
+	}
+
+	parsedURL.User = url.UserPassword(databaseUser, databasePassword)
+	return parsedURL.String()
+}
+
+// ---
+// Returns comma-separated values with surrounding whitespace and empty values removed.
+func (loader *configLoader) list(name string) []string {
+	values := []string{}
+	for _, value := range strings.Split(os.Getenv(name), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+
+	return values
+}
+
+// ---
+// Returns configuration loaded from environment variables and a list of all
+// problems encountered, which is empty if configuration is valid.
+func loadConfig() (Config, []string) {
+	loader := &configLoader{}
+	config := Config{}
+
+	config.AccessKey = loader.required("APP_ACCESS_KEY")
+	config.ReadOnlyAccessKey = os.Getenv("APP_READONLY_ACCESS_KEY")
+	config.AdminKey = os.Getenv("APP_ADMIN_ACCESS_KEY")
+	config.DefaultUser = os.Getenv("APP_DEFAULT_USER")
+	config.ShareSecret = os.Getenv("APP_SHARE_SECRET")
+	config.ShareTTL = loader.duration("APP_SHARE_TTL", 15 * time.Minute)
+
+	if config.ShareSecret != "" && len(config.ShareSecret) < 32 {
+		loader.addProblem("Environment variable APP_SHARE_SECRET must be at least 32 characters")
+	}
+	config.BackfillMaxSkew = loader.duration("APP_BACKFILL_MAX_SKEW", time.Minute)
+
+	if config.ReadOnlyAccessKey != "" && config.ReadOnlyAccessKey == config.AccessKey {
+		loader.addProblem("Environment variable APP_READONLY_ACCESS_KEY equals APP_ACCESS_KEY")
+	}
+
+	config.DatabaseURL = loader.databaseURL(
+		"APP_DATABASE_URL", loader.required("APP_DATABASE_URL"), "APP_DATABASE")
+	config.DatabaseReadURL = loader.databaseURL(
+		"APP_DATABASE_READ_URL", os.Getenv("APP_DATABASE_READ_URL"), "APP_DATABASE")
+
+	// The shadow database is usually a separate cluster with its own credentials
+	config.DatabaseShadowURL = loader.databaseURL(
+		"APP_DATABASE_SHADOW_URL", os.Getenv("APP_DATABASE_SHADOW_URL"),
+		"APP_DATABASE_SHADOW")
+
+	// Credentials are only used if both are set, which is easily missed
+	for _, prefix := range []string{"APP_DATABASE", "APP_DATABASE_SHADOW"} {
+		databaseUser := os.Getenv(prefix + "_USER")
+		databasePassword := os.Getenv(prefix + "_PASSWORD")
+		if databaseUser != "" && databasePassword == "" {
+			loader.addProblem(
+				"Environment variable %s_PASSWORD is missing, but %s_USER is set", prefix, prefix)
+
+		} else if databaseUser == "" && databasePassword != "" {
+			loader.addProblem(
+				"Environment variable %s_USER is missing, but %s_PASSWORD is set", prefix, prefix)
+		}
+	}
+
+	config.DatabaseHeaders = http.Header{}
+	for _, pair := range loader.list("APP_DATABASE_HEADERS") {
+		name, value, found := strings.Cut(pair, ":")
+		name = strings.TrimSpace(name)
+		if !found || name == "" {
+			loader.addProblem(
+				"Environment variable APP_DATABASE_HEADERS must contain \"Name:Value\" pairs")
+
+			continue
+		}
+
+		config.DatabaseHeaders.Add(name, strings.TrimSpace(value))
+	}
+
+	config.RequestTimeout = loader.duration("APP_REQUEST_TIMEOUT", 30 * time.Second)
+	if config.RequestTimeout == 0 {
+		loader.addProblem("Environment variable APP_REQUEST_TIMEOUT is zero")
+	}
+
+	config.DatabaseTimeout = loader.duration("APP_DATABASE_TIMEOUT", 5 * time.Second)
+	config.DatabaseMaxTimeout = loader.duration(
+		"APP_DATABASE_MAX_TIMEOUT", config.RequestTimeout)
+
+	if config.DatabaseTimeout == 0 || config.DatabaseMaxTimeout == 0 {
+		loader.addProblem("Environment variable APP_DATABASE_TIMEOUT or APP_DATABASE_MAX_TIMEOUT is zero")
+	}
+
+	if config.DatabaseTimeout > config.DatabaseMaxTimeout {
+		loader.addProblem("Environment variable APP_DATABASE_TIMEOUT exceeds APP_DATABASE_MAX_TIMEOUT")
+	}
+
+	// Queries can't outlive the request, which is aborted after RequestTimeout
+	if config.DatabaseMaxTimeout > config.RequestTimeout {
+		loader.addProblem(
+			"Environment variable APP_DATABASE_MAX_TIMEOUT exceeds APP_REQUEST_TIMEOUT")
+	}
+
+	config.DatabaseWriteAttempts = loader.integer("APP_DATABASE_WRITE_ATTEMPTS", 3, 1)
+	config.QueuedWrites = loader.boolean("APP_DB_QUEUED_WRITES")
+	config.DatabaseStartupAttempts = loader.integer("APP_DATABASE_STARTUP_ATTEMPTS", 10, 1)
+	config.BackoffBase = loader.duration("APP_DATABASE_BACKOFF_BASE", 100 * time.Millisecond)
+	config.BackoffCap = loader.duration("APP_DATABASE_BACKOFF_CAP", 5 * time.Second)
+
+	if config.BackoffBase == 0 || config.BackoffBase > config.BackoffCap {
+		loader.addProblem(
+			"Environment variable APP_DATABASE_BACKOFF_BASE must be non-zero and " +
+			"not exceed APP_DATABASE_BACKOFF_CAP")
+	}
+	config.SlowQueryThreshold = time.Duration(
+		loader.integer("APP_SLOW_QUERY_MS", 0, 0)) * time.Millisecond
+
+	config.HealthQuery = os.Getenv("APP_HEALTH_QUERY")
+	config.CaseInsensitiveUsers = loader.boolean("APP_CASE_INSENSITIVE_USERS")
+
+	config.RecipesURL = os.Getenv("APP_RECIPES_URL")
+	loader.httpURL("APP_RECIPES_URL", config.RecipesURL)
+
+	config.SeedData = loader.boolean("APP_SEED_DATA")
+
+	if loader.boolean("APP_WARMUP") {
+		config.WarmupQueries = loader.integer("APP_WARMUP_QUERIES", 4, 1)
+	}
+
+	config.DedupWindow = loader.duration("APP_DEDUP_WINDOW", 2 * time.Second)
+	config.IDsAsStrings = loader.boolean("APP_IDS_AS_STRINGS")
+
+	if value := os.Getenv("APP_DRINK_ALIASES"); value != "" {
+		aliases, err := parseDrinkAliases(value)
+		if err != nil {
+			loader.addProblem("Environment variable APP_DRINK_ALIASES is invalid: %s", err)
+		}
+
+		config.DrinkAliases = aliases
+	}
+
+	if value := os.Getenv("APP_ALLOWED_DRINKS"); value != "" {
+		allowedDrinks, err := parseAllowedDrinks(value)
+		if err != nil {
+			loader.addProblem("Environment variable APP_ALLOWED_DRINKS is invalid: %s", err)
+
+		} else if len(allowedDrinks) == 0 {
+			loader.addProblem("Environment variable APP_ALLOWED_DRINKS contains no drinks")
+		}
+
+		config.AllowedDrinks = allowedDrinks
+	}
+
+	config.AutocompleteMax = loader.integer("APP_AUTOCOMPLETE_MAX", 20, 1)
+	config.MaxPaginationOffset = loader.integer("APP_MAX_PAGINATION_OFFSET", 10000, 0)
+
+	config.MetricsDrinks = loader.list("APP_METRICS_DRINKS")
+	config.MetricsMaxDrinks = loader.integer("APP_METRICS_MAX_DRINKS", 50, 0)
+	config.EnableDebug = loader.boolean("APP_ENABLE_DEBUG")
+	config.DebugLogBodies = loader.boolean("APP_DEBUG_LOG_BODIES")
+	config.DebugLogBodyLimit = loader.integer("APP_DEBUG_LOG_BODY_LIMIT", 1024, 0)
+	config.MaxHeaderBytes = loader.integer(
+		"APP_MAX_HEADER_BYTES", http.DefaultMaxHeaderBytes, 1)
+
+	config.MaxBodyBytes = loader.integer("APP_MAX_BODY_BYTES", 1 << 20, 1)
+
+	for _, rawWindow := range loader.list("APP_MAINTENANCE_SCHEDULE") {
+		rawStart, rawEnd, _ := strings.Cut(rawWindow, "/")
+		start, startErr := time.Parse(time.RFC3339, rawStart)
+		end, endErr := time.Parse(time.RFC3339, rawEnd)
+		if startErr != nil || endErr != nil || !end.After(start) {
+			loader.addProblem(
+				"Environment variable APP_MAINTENANCE_SCHEDULE contains invalid window \"%s\"",
+				rawWindow)
+
+			continue
+		}
+
+		config.MaintenanceWindows = append(
+			config.MaintenanceWindows, maintenanceWindow{Start: start, End: end})
+	}
+
+	config.AdminAddress = os.Getenv("APP_ADMIN_ADDRESS")
+
+	// Trailing slashes are removed to keep "/api/..." paths intact when stripping
+	config.PathPrefix = strings.TrimRight(os.Getenv("APP_PATH_PREFIX"), "/")
+	if config.PathPrefix != "" && !strings.HasPrefix(config.PathPrefix, "/") {
+		loader.addProblem("Environment variable APP_PATH_PREFIX must start with \"/\"")
+	}
+
+	config.TrailingSlash = os.Getenv("APP_TRAILING_SLASH")
+	if config.TrailingSlash == "" {
+		config.TrailingSlash = "strip"
+
+	} else if config.TrailingSlash != "strip" && config.TrailingSlash != "redirect" {
+		loader.addProblem(
+			"Environment variable APP_TRAILING_SLASH must be \"strip\" or \"redirect\": \"%s\"",
+			config.TrailingSlash)
+	}
+
+	config.MaxConnectionsPerIP = loader.integer("APP_MAX_CONNS_PER_IP", 0, 0)
+
+	for _, rawProxy := range loader.list("APP_TRUSTED_PROXIES") {
+		prefix, err := netip.ParsePrefix(rawProxy)
+		if address, addressErr := netip.ParseAddr(rawProxy); addressErr == nil {
+			prefix, err = address.Prefix(address.BitLen())
+		}
+
+		if err != nil {
+			loader.addProblem(
+				"Environment variable APP_TRUSTED_PROXIES contains invalid address \"%s\"",
+				rawProxy)
+
+			continue
+		}
+
+		config.TrustedProxies = append(config.TrustedProxies, prefix.Masked())
+	}
+	config.EnableH2C = loader.boolean("APP_ENABLE_H2C")
+
+	config.Compression = loader.list("APP_COMPRESSION")
+	if len(config.Compression) == 0 {
+		config.Compression = []string{"gzip"}
+
+	} else if len(config.Compression) == 1 && config.Compression[0] == "none" {
+		config.Compression = nil
+	}
+
+	for _, algorithm := range config.Compression {
+		if compressionAlgorithms[algorithm] == nil {
+			loader.addProblem(
+				"Environment variable APP_COMPRESSION contains unsupported algorithm \"%s\"",
+				algorithm)
+		}
+	}
+
+	return config, loader.problems
+}
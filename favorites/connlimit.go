@@ -0,0 +1,190 @@
+// Limiting of concurrent connections per client IP address.
+
+package main
+
+import (
+	"net"
+	"log"
+	"sync"
+	"strings"
+	"net/http"
+	"net/netip"
+)
+
+// ---
+// Counts concurrent uses (such as connections) per IP address, up to a maximum.
+type ipLimiter struct {
+	maxPerIP int
+	mutex sync.Mutex
+	counts map[string]int
+}
+
+// ---
+func newIPLimiter(maxPerIP int) *ipLimiter {
+	return &ipLimiter{maxPerIP: maxPerIP, counts: map[string]int{}}
+}
+
+// ---
+// Returns false if IP address is already at the maximum, counts a use otherwise.
+func (limiter *ipLimiter) acquire(ip string) bool {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	if limiter.counts[ip] >= limiter.maxPerIP {
+		return false
+	}
+
+	limiter.counts[ip]++
+	return true
+}
+
+// ---
+func (limiter *ipLimiter) release(ip string) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	limiter.counts[ip]--
+	if limiter.counts[ip] <= 0 {
+		delete(limiter.counts, ip)
+	}
+}
+
+// ---
+// Returns IP address of network address such as "192.0.2.1:1234".
+func addressIP(address string) string {
+	ip, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+
+	return ip
+}
+
+// ---
+// Returns true if IP address is within one of the trusted proxy prefixes.
+func isTrustedProxy(ip string, trustedProxies []netip.Prefix) bool {
+	parsedIP, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(parsedIP.Unmap()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ---
+// Returns IP address of client making request. If the peer is a trusted proxy,
+// the "X-Forwarded-For" header is followed from the right, skipping trusted
+// proxies, as addresses to the left of them may be spoofed by clients.
+func clientIP(request *http.Request, trustedProxies []netip.Prefix) string {
+	ip := addressIP(request.RemoteAddr)
+	if !isTrustedProxy(ip, trustedProxies) {
+		return ip
+	}
+
+	forwardedIPs := strings.Split(strings.Join(request.Header.Values("X-Forwarded-For"), ","), ",")
+	for index := len(forwardedIPs) - 1; index >= 0; index-- {
+		forwardedIP := strings.TrimSpace(forwardedIPs[index])
+		if forwardedIP == "" {
+			continue
+		}
+
+		ip = forwardedIP
+		if !isTrustedProxy(ip, trustedProxies) {
+			break
+		}
+	}
+
+	return ip
+}
+
+// ---
+// Wraps listener to close accepted connections from IP addresses that already
+// have the maximum number of open connections. Connections from trusted
+// proxies aren't limited, as they are shared by many clients, which are
+// limited by withProxiedClientLimit instead.
+type connectionLimitListener struct {
+	net.Listener
+	limiter *ipLimiter
+	trustedProxies []netip.Prefix
+}
+
+// ---
+func newConnectionLimitListener(
+	listener net.Listener, maxPerIP int,
+	trustedProxies []netip.Prefix) *connectionLimitListener {
+
+	return &connectionLimitListener{
+		Listener: listener, limiter: newIPLimiter(maxPerIP), trustedProxies: trustedProxies}
+}
+
+// ---
+func (listener *connectionLimitListener) Accept() (net.Conn, error) {
+	for {
+		connection, err := listener.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		ip := addressIP(connection.RemoteAddr().String())
+		if isTrustedProxy(ip, listener.trustedProxies) {
+			return connection, nil
+		}
+
+		if !listener.limiter.acquire(ip) {
+			log.Printf("Closing connection from \"%s\" exceeding per-IP connection limit", ip)
+			connection.Close()
+			continue
+		}
+
+		return &limitedConnection{Conn: connection, limiter: listener.limiter, ip: ip}, nil
+	}
+}
+
+// ---
+// Connection releasing its slot in the listener's limit once closed.
+type limitedConnection struct {
+	net.Conn
+	limiter *ipLimiter
+	ip string
+	closeOnce sync.Once
+}
+
+// ---
+func (connection *limitedConnection) Close() error {
+	err := connection.Conn.Close()
+	connection.closeOnce.Do(func() { connection.limiter.release(connection.ip) })
+	return err
+}
+
+// ---
+// Returns handler limiting concurrent requests per client received through
+// trusted proxies, identified using clientIP, responding with status 429 to
+// requests over the limit. Requests from other peers are limited per
+// connection by connectionLimitListener instead.
+func withProxiedClientLimit(
+	handler http.Handler, maxPerIP int, trustedProxies []netip.Prefix) http.Handler {
+
+	limiter := newIPLimiter(maxPerIP)
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if !isTrustedProxy(addressIP(request.RemoteAddr), trustedProxies) {
+			handler.ServeHTTP(response, request)
+			return
+		}
+
+		ip := clientIP(request, trustedProxies)
+		if !limiter.acquire(ip) {
+			log.Printf("Rejecting request from \"%s\" exceeding per-IP concurrency limit", ip)
+			writeError(response, errorTooManyRequests, "Too many concurrent requests")
+			return
+		}
+
+		defer limiter.release(ip)
+		handler.ServeHTTP(response, request)
+	})
+}
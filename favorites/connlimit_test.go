@@ -0,0 +1,193 @@
+// Tests of limiting concurrent connections and requests per client IP address.
+
+package main
+
+import (
+	"io"
+	"net"
+	"time"
+	"testing"
+	"net/http"
+	"net/netip"
+	"net/http/httptest"
+)
+
+// ---
+// Returns loopback listener limited to maxPerIP connections per IP address, and
+// channel receiving its accepted connections.
+func newTestLimitListener(
+	t *testing.T, maxPerIP int,
+	trustedProxies []netip.Prefix) (*connectionLimitListener, chan net.Conn) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+
+	limitListener := newConnectionLimitListener(listener, maxPerIP, trustedProxies)
+	t.Cleanup(func() { limitListener.Close() })
+
+	accepted := make(chan net.Conn)
+	go func() {
+		for {
+			connection, err := limitListener.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+
+			accepted <- connection
+		}
+	}()
+
+	return limitListener, accepted
+}
+
+// ---
+// Connects to listener, returning client side of connection.
+func dialTestListener(t *testing.T, listener net.Listener) net.Conn {
+	connection, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+
+	t.Cleanup(func() { connection.Close() })
+	return connection
+}
+
+// ---
+func receiveAccepted(t *testing.T, accepted chan net.Conn) net.Conn {
+	select {
+	case connection := <-accepted:
+		return connection
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected connection to be accepted")
+		return nil
+	}
+}
+
+// ---
+func TestConnectionsOverLimitAreClosed(t *testing.T) {
+	listener, accepted := newTestLimitListener(t, 1, nil)
+
+	dialTestListener(t, listener)
+	first := receiveAccepted(t, accepted)
+
+	rejected := dialTestListener(t, listener)
+	rejected.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := rejected.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected connection over limit to be closed, got error: %v", err)
+	}
+
+	select {
+	case <-accepted:
+		t.Fatalf("Expected connection over limit not to be accepted")
+	default:
+	}
+
+	// Closing twice must only release one slot
+	first.Close()
+	first.Close()
+
+	dialTestListener(t, listener)
+	second := receiveAccepted(t, accepted)
+	if count := listener.limiter.counts["127.0.0.1"]; count != 1 {
+		t.Errorf("Expected one counted connection after closing twice, got %d", count)
+	}
+
+	second.Close()
+	second.Close()
+	if len(listener.limiter.counts) != 0 {
+		t.Errorf("Expected no counted connections once closed, got %v", listener.limiter.counts)
+	}
+}
+
+// ---
+func TestConnectionsFromTrustedProxiesAreNotLimited(t *testing.T) {
+	trustedProxies := []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}
+	listener, accepted := newTestLimitListener(t, 1, trustedProxies)
+
+	for range 3 {
+		dialTestListener(t, listener)
+		receiveAccepted(t, accepted)
+	}
+}
+
+// ---
+func TestClientIPFollowsForwardedForFromTrustedProxies(t *testing.T) {
+	trustedProxies := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	cases := []struct {
+		name string
+		remoteAddress string
+		forwardedFor string
+		ip string
+	}{
+		{"untrusted peer", "192.0.2.1:1234", "198.51.100.1", "192.0.2.1"},
+		{"trusted proxy", "10.0.0.1:1234", "198.51.100.1", "198.51.100.1"},
+		{"spoofed address", "10.0.0.1:1234", "203.0.113.9, 198.51.100.1", "198.51.100.1"},
+		{"proxy chain", "10.0.0.1:1234", "198.51.100.1, 10.0.0.2", "198.51.100.1"},
+		{"missing header", "10.0.0.1:1234", "", "10.0.0.1"},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			request := httptest.NewRequest("GET", "/api/favorites/ada", nil)
+			request.RemoteAddr = testCase.remoteAddress
+			if testCase.forwardedFor != "" {
+				request.Header.Set("X-Forwarded-For", testCase.forwardedFor)
+			}
+
+			if ip := clientIP(request, trustedProxies); ip != testCase.ip {
+				t.Errorf("Expected client IP \"%s\", got \"%s\"", testCase.ip, ip)
+			}
+		})
+	}
+}
+
+// ---
+func TestProxiedRequestsOverLimitAreRejected(t *testing.T) {
+	trustedProxies := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	entered, proceed := make(chan struct{}), make(chan struct{})
+	handler := withProxiedClientLimit(
+		http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			if request.Header.Get("X-Test-Block") != "" {
+				entered <- struct{}{}
+				<-proceed
+			}
+		}), 1, trustedProxies)
+
+	newProxiedRequest := func(clientIP string) *http.Request {
+		request := newTestRequest("GET", "/api/favorites/ada", "")
+		request.RemoteAddr = "10.0.0.1:1234"
+		request.Header.Set("X-Forwarded-For", clientIP)
+		return request
+	}
+
+	done := make(chan struct{})
+	go func() {
+		request := newProxiedRequest("198.51.100.1")
+		request.Header.Set("X-Test-Block", "true")
+		serve(handler, request)
+		close(done)
+	}()
+
+	<-entered
+	response := serve(handler, newProxiedRequest("198.51.100.1"))
+	if response.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status 429 for request over limit, got %d", response.Code)
+	}
+
+	// Other clients of the same proxy have their own limit
+	response = serve(handler, newProxiedRequest("198.51.100.2"))
+	if response.Code != http.StatusOK {
+		t.Errorf("Expected status 200 for other client, got %d", response.Code)
+	}
+
+	proceed <- struct{}{}
+	<-done
+
+	response = serve(handler, newProxiedRequest("198.51.100.1"))
+	if response.Code != http.StatusOK {
+		t.Errorf("Expected status 200 once earlier request finished, got %d", response.Code)
+	}
+}
@@ -0,0 +1,63 @@
+// Short-lived in-memory tracking of recently added favorites, used to collapse
+// rapid-fire identical requests (such as a double-tapped button) into one.
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type deduplicator struct {
+	mutex sync.Mutex
+	window time.Duration
+	maxEntries int
+	entries map[[2]string]time.Time
+}
+
+// ---
+func newDeduplicator(window time.Duration, maxEntries int) *deduplicator {
+	return &deduplicator{
+		window: window, maxEntries: maxEntries, entries: map[[2]string]time.Time{}}
+}
+
+// ---
+// Records user/drink pair and returns true, unless the pair was already
+// claimed within the deduplication window. If tracking is at capacity even
+// after expired entries are removed, requests are let through untracked to keep
+// memory usage bounded.
+func (dedup *deduplicator) Claim(user string, drink string) bool {
+	key := [2]string{user, drink}
+	now := time.Now()
+
+	dedup.mutex.Lock()
+	defer dedup.mutex.Unlock()
+
+	claimed, exists := dedup.entries[key]
+	if exists && now.Sub(claimed) < dedup.window {
+		return false
+	}
+
+	if len(dedup.entries) >= dedup.maxEntries {
+		for entryKey, entryClaimed := range dedup.entries {
+			if now.Sub(entryClaimed) >= dedup.window {
+				delete(dedup.entries, entryKey)
+			}
+		}
+	}
+
+	if len(dedup.entries) < dedup.maxEntries {
+		dedup.entries[key] = now
+	}
+
+	return true
+}
+
+// ---
+// Removes claim for user/drink pair, such as if adding the favorite failed.
+func (dedup *deduplicator) Release(user string, drink string) {
+	dedup.mutex.Lock()
+	defer dedup.mutex.Unlock()
+
+	delete(dedup.entries, [2]string{user, drink})
+}
@@ -0,0 +1,80 @@
+// Error responses, which are JSON objects containing a human-readable message
+// and a machine-readable code, such as {"code":"INVALID_ACCESS_KEY","error":"..."}.
+// Messages are localized as described in i18n.go, while codes are not.
+
+package main
+
+import (
+	"net/http"
+	"encoding/json"
+)
+
+// ---
+// Machine-readable error code and the HTTP status code responded with. Unlike
+// messages, error codes are stable and may be relied upon by clients.
+type errorCode struct {
+	name string
+	status int
+}
+
+var (
+	errorMethodNotAllowed = errorCode{"METHOD_NOT_ALLOWED", http.StatusMethodNotAllowed}
+	errorNotFound = errorCode{"NOT_FOUND", http.StatusNotFound}
+	errorInvalidAccessKey = errorCode{"INVALID_ACCESS_KEY", http.StatusUnauthorized}
+	errorReadOnlyAccessKey = errorCode{"READ_ONLY_ACCESS_KEY", http.StatusForbidden}
+	errorInvalidAdminKey = errorCode{"INVALID_ADMIN_KEY", http.StatusUnauthorized}
+	errorInvalidUsername = errorCode{"INVALID_USERNAME", http.StatusBadRequest}
+	errorInvalidBody = errorCode{"INVALID_BODY", http.StatusBadRequest}
+	errorBodyTooLarge = errorCode{"BODY_TOO_LARGE", http.StatusRequestEntityTooLarge}
+	errorUnsupportedEncoding = errorCode{"UNSUPPORTED_ENCODING", http.StatusUnsupportedMediaType}
+	errorInvalidCategory = errorCode{"INVALID_CATEGORY", http.StatusBadRequest}
+	errorDrinkNotAllowed = errorCode{"DRINK_NOT_ALLOWED", http.StatusUnprocessableEntity}
+	errorInvalidTimestamp = errorCode{"INVALID_TIMESTAMP", http.StatusBadRequest}
+	errorTimestampNotAllowed = errorCode{"TIMESTAMP_NOT_ALLOWED", http.StatusForbidden}
+	errorInvalidParameter = errorCode{"INVALID_PARAMETER", http.StatusBadRequest}
+	errorInvalidQueryTimeout = errorCode{"INVALID_QUERY_TIMEOUT", http.StatusBadRequest}
+	errorSharingDisabled = errorCode{"SHARING_DISABLED", http.StatusNotFound}
+	errorInvalidShareToken = errorCode{"INVALID_SHARE_TOKEN", http.StatusForbidden}
+	errorNotFavorite = errorCode{"NOT_FAVORITE", http.StatusNotFound}
+	errorNothingToUndo = errorCode{"NOTHING_TO_UNDO", http.StatusNotFound}
+	errorUndoConflict = errorCode{"UNDO_CONFLICT", http.StatusConflict}
+	errorClientIDConflict = errorCode{"CLIENT_ID_CONFLICT", http.StatusConflict}
+	errorDatabaseUnavailable = errorCode{"DB_UNAVAILABLE", http.StatusInternalServerError}
+	errorInternal = errorCode{"INTERNAL_ERROR", http.StatusInternalServerError}
+	errorRenderFailed = errorCode{"RENDER_FAILED", http.StatusInternalServerError}
+	errorStoreNotReady = errorCode{"STORE_NOT_READY", http.StatusServiceUnavailable}
+	errorDraining = errorCode{"DRAINING", http.StatusServiceUnavailable}
+	errorWritesPaused = errorCode{"WRITES_PAUSED", http.StatusServiceUnavailable}
+	errorTooManyRequests = errorCode{"TOO_MANY_REQUESTS", http.StatusTooManyRequests}
+	errorRequestTimeout = errorCode{"REQUEST_TIMEOUT", http.StatusServiceUnavailable}
+)
+
+// ---
+type errorResponse struct {
+	Code string `json:"code"`
+	Error string `json:"error"`
+	Problems []validationProblem `json:"problems,omitempty"`
+}
+
+// ---
+// Responds with status of error code and a JSON object containing its name and message.
+func writeError(response http.ResponseWriter, code errorCode, message string) {
+	writeErrorResponse(response, code, errorResponse{Error: message})
+}
+
+// ---
+func writeErrorResponse(response http.ResponseWriter, code errorCode, errorData errorResponse) {
+	var language string
+	errorData.Code = code.name
+	errorData.Error, language = localizeError(response, code, errorData.Error)
+	if language != "" {
+		response.Header().Set("Content-Language", language)
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	response.Header().Set("X-Content-Type-Options", "nosniff")
+	response.WriteHeader(code.status)
+
+	responseData, _ := json.Marshal(errorData)
+	response.Write(responseData)
+}
@@ -0,0 +1,84 @@
+// Tests of JSON error responses.
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"net/http"
+	"encoding/json"
+)
+
+// ---
+func TestErrorsHaveStableCodes(t *testing.T) {
+	cases := []struct {
+		name string
+		request *http.Request
+		status int
+		code string
+	}{
+		{
+			"malformed body",
+			newTestRequest("POST", "/api/favorites/ada", `{"drink":`),
+			400, "INVALID_BODY"},
+		{
+			"timestamp from non-admin",
+			newTestRequest(
+				"POST", "/api/favorites/ada",
+				`{"drink":"Negroni","timestamp":"2020-01-01T00:00:00Z"}`),
+			403, "TIMESTAMP_NOT_ALLOWED"},
+		{
+			"nothing to undo",
+			newTestRequest("POST", "/api/favorites/ada/undo", ""),
+			404, "NOTHING_TO_UNDO"},
+		{
+			"unsupported method",
+			newTestRequest("DELETE", "/api/favorites/ada", ""),
+			405, "METHOD_NOT_ALLOWED"},
+		{
+			"client identifier of other user",
+			newTestRequest(
+				"POST", "/api/favorites/ada",
+				`{"drink":"Negroni","clientId":"6f1c2a4e-0d1b-4c8e-9a57-3b2f0e7d9c11"}`),
+			409, "CLIENT_ID_CONFLICT"},
+		{
+			"oversized body",
+			newTestRequest(
+				"POST", "/api/favorites/ada", `"` + strings.Repeat("a", 2 << 20) + `"`),
+			413, "BODY_TOO_LARGE"},
+	}
+
+	store := &fakeStore{favorites: []fakeFavorite{{user: "bob", storedFavorite: storedFavorite{
+		ID: 1, Drink: "Negroni", ClientID: "6f1c2a4e-0d1b-4c8e-9a57-3b2f0e7d9c11"}}}}
+
+	server, handler := newTestHandler(testConfig(t), store)
+	checkError := func(t *testing.T, request *http.Request, status int, code string) {
+		response := serve(handler, request)
+		if response.Code != status {
+			t.Errorf("Expected status %d, got %d: %s", status, response.Code, response.Body)
+		}
+
+		contentType := response.Header().Get("Content-Type")
+		if contentType != "application/json" {
+			t.Errorf("Expected JSON error, got content type \"%s\"", contentType)
+		}
+
+		var body errorResponse
+		err := json.Unmarshal(response.Body.Bytes(), &body)
+		if err != nil || body.Code != code {
+			t.Errorf("Expected error code %s, got %s", code, response.Body)
+		}
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			checkError(t, testCase.request, testCase.status, testCase.code)
+		})
+	}
+
+	t.Run("store not ready", func(t *testing.T) {
+		server.storeReady.Store(false)
+		checkError(
+			t, newTestRequest("GET", "/api/favorites/ada", ""), 503, "STORE_NOT_READY")
+	})
+}
@@ -3,5 +3,22 @@ module favorites_server/main
 go 1.23
 
 require (
+	github.com/klauspost/compress v1.17.9
+	github.com/prometheus/client_golang v1.20.5
 	github.com/rqlite/gorqlite v0.0.0-20250128004930-114c7828b55a
+	github.com/santhosh-tekuri/jsonschema/v5 v5.3.1
+	golang.org/x/net v0.34.0
+	golang.org/x/sync v0.10.0
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/munnerz/goautoneg v0.0.0-20191010083416-a7dc8b61c822 // indirect
+	github.com/prometheus/client_model v0.6.1 // indirect
+	github.com/prometheus/common v0.55.0 // indirect
+	github.com/prometheus/procfs v0.15.1 // indirect
+	golang.org/x/sys v0.29.0 // indirect
+	golang.org/x/text v0.21.0 // indirect
+	google.golang.org/protobuf v1.34.2 // indirect
 )
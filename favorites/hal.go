@@ -0,0 +1,75 @@
+// HAL (Hypertext Application Language) representation of favorites, used for
+// clients requesting it using the "Accept" header.
+
+package main
+
+import (
+	"strconv"
+	"strings"
+	"net/http"
+	"encoding/json"
+)
+
+type halLink struct {
+	Href string `json:"href"`
+}
+
+type halFavorite struct {
+	Drink string `json:"drink"`
+}
+
+// ---
+// Returns true if media type is listed in "Accept" header of request, unless
+// it's explicitly marked as not acceptable using quality value "0".
+func acceptsMediaType(request *http.Request, mediaType string) bool {
+	for _, acceptedType := range strings.Split(request.Header.Get("Accept"), ",") {
+		acceptedType, parameters, _ := strings.Cut(acceptedType, ";")
+		if !strings.EqualFold(strings.TrimSpace(acceptedType), mediaType) {
+			continue
+		}
+
+		for _, parameter := range strings.Split(parameters, ";") {
+			name, value, _ := strings.Cut(parameter, "=")
+			if strings.TrimSpace(name) == "q" {
+				quality, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+				return err != nil || quality > 0
+			}
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// ---
+// Writes favorites with links to self and to pages (by relation type) if paginated,
+// including the cursor of the next page (if any).
+func writeFavoritesHAL(
+	response http.ResponseWriter, selfURL string, pageURLs map[string]string,
+	nextCursor string, favorites []string) {
+
+	items := []halFavorite{}
+	for _, favorite := range favorites {
+		items = append(items, halFavorite{Drink: favorite})
+	}
+
+	links := map[string]halLink{"self": {Href: selfURL}}
+	for relation, pageURL := range pageURLs {
+		links[relation] = halLink{Href: pageURL}
+	}
+
+	document := map[string]interface{}{
+		"_links": links,
+		"_embedded": map[string][]halFavorite{"favorites": items},
+		"count": len(items)}
+
+	if nextCursor != "" {
+		document["nextCursor"] = nextCursor
+	}
+
+	responseData, _ := json.Marshal(document)
+
+	response.Header().Set("Content-Type", "application/hal+json")
+	response.Write(responseData)
+}
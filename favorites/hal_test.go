@@ -0,0 +1,30 @@
+// Tests of HAL representation of favorites.
+
+package main
+
+import (
+	"testing"
+	"net/http/httptest"
+)
+
+// ---
+func TestAcceptsMediaType(t *testing.T) {
+	cases := map[string]bool{
+		"": false,
+		"application/json": false,
+		"application/hal+json": true,
+		"application/json, Application/HAL+JSON": true,
+		"application/hal+json;q=0.5": true,
+		"application/hal+json; q=0": false,
+		"application/hal+json;q=0.0, application/json": false,
+	}
+
+	for accept, expected := range cases {
+		request := httptest.NewRequest("GET", "/api/favorites/ada", nil)
+		request.Header.Set("Accept", accept)
+
+		if accepted := acceptsMediaType(request, "application/hal+json"); accepted != expected {
+			t.Errorf("Expected %t for \"Accept: %s\", got %t", expected, accept, accepted)
+		}
+	}
+}
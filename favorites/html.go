@@ -0,0 +1,53 @@
+// HTML representation of favorites, intended for quick browsing in demos.
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"html/template"
+)
+
+// Values are escaped by html/template, preventing injection of markup/scripts
+var favoritesTemplate = template.Must(template.New("favorites").Parse(`<!DOCTYPE html>
+<html>
+<meta charset="UTF-8">
+<head>
+<title>&#128151; Favorites of {{ .User }}</title>
+<style type="text/css">
+* {
+    background-color: black;
+    color: lightgreen;
+    font-family: monospace;
+}
+</style>
+</head>
+<body>
+<h1>&#128151; Favorites of {{ .User }}</h1>
+{{ if .Favorites }}
+<ul>
+{{ range .Favorites }}<li>{{ . }}</li>
+{{ end }}
+</ul>
+{{ else }}
+<p>No favorites yet!</p>
+{{ end }}
+</body>
+</html>
+`))
+
+// ---
+func writeFavoritesHTML(response http.ResponseWriter, user string, favorites []string) error {
+	var page bytes.Buffer
+
+	err := favoritesTemplate.Execute(
+		&page, struct{User string; Favorites []string}{user, favorites})
+
+	if err != nil {
+		return err
+	}
+
+	response.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, err = response.Write(page.Bytes())
+	return err
+}
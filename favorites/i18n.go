@@ -0,0 +1,159 @@
+// Localization of error messages based on the "Accept-Language" header.
+//
+// Messages are looked up in catalogs by error code, as English messages may
+// differ between end-points. To add a language, add a catalog for its primary
+// language subtag (such as "fr") to errorCatalogs, translating the generic
+// meaning of each error code. Codes missing from a catalog (such as those of
+// errors with messages detailing the problem) fall back to the English message.
+
+package main
+
+import (
+	"strconv"
+	"strings"
+	"net/http"
+)
+
+var errorCatalogs = map[string]map[string]string{
+	"sv": {
+		"METHOD_NOT_ALLOWED": "Metoden är inte tillåten",
+		"NOT_FOUND": "Resursen hittades inte",
+		"INVALID_ACCESS_KEY": "Ogiltig åtkomstnyckel",
+		"READ_ONLY_ACCESS_KEY": "Åtkomstnyckeln ger endast läsbehörighet",
+		"INVALID_ADMIN_KEY": "Ogiltig administratörsnyckel",
+		"INVALID_USERNAME": "Ogiltigt eller saknat användarnamn",
+		"INVALID_BODY": "Ogiltigt innehåll i förfrågan",
+		"BODY_TOO_LARGE": "Innehållet i förfrågan är för stort",
+		"INVALID_CATEGORY": "Ogiltig kategori",
+		"DRINK_NOT_ALLOWED": "Drinken finns inte på menyn",
+		"INVALID_TIMESTAMP": "Ogiltig tidsstämpel",
+		"TIMESTAMP_NOT_ALLOWED": "Tidsstämpel får endast anges av administratörer",
+		"INVALID_QUERY_TIMEOUT": "Ogiltig tidsgräns för databasfrågor",
+		"SHARING_DISABLED": "Delning av favoriter är avstängd",
+		"INVALID_SHARE_TOKEN": "Ogiltig eller utgången delningslänk",
+		"NOT_FAVORITE": "Favoriten hittades inte",
+		"NOTHING_TO_UNDO": "Det finns inget att ångra",
+		"UNDO_CONFLICT": "Favoriten har ändrats sedan åtgärden",
+		"CLIENT_ID_CONFLICT": "Klientidentifieraren används redan",
+		"DB_UNAVAILABLE": "Databasen är inte tillgänglig",
+		"INTERNAL_ERROR": "Internt serverfel",
+		"RENDER_FAILED": "Misslyckades att visa favoriter",
+		"STORE_NOT_READY": "Databasen förbereds",
+		"DRAINING": "Servern håller på att stängas av",
+		"WRITES_PAUSED": "Ändringar är pausade för underhåll",
+		"TOO_MANY_REQUESTS": "För många samtidiga förfrågningar"},
+	"de": {
+		"METHOD_NOT_ALLOWED": "Methode nicht erlaubt",
+		"NOT_FOUND": "Ressource nicht gefunden",
+		"INVALID_ACCESS_KEY": "Ungültiger Zugriffsschlüssel",
+		"READ_ONLY_ACCESS_KEY": "Zugriffsschlüssel erlaubt nur Lesezugriff",
+		"INVALID_ADMIN_KEY": "Ungültiger Administratorschlüssel",
+		"INVALID_USERNAME": "Ungültiger oder fehlender Benutzername",
+		"INVALID_BODY": "Ungültiger Inhalt der Anfrage",
+		"BODY_TOO_LARGE": "Der Inhalt der Anfrage ist zu groß",
+		"INVALID_CATEGORY": "Ungültige Kategorie",
+		"DRINK_NOT_ALLOWED": "Das Getränk steht nicht auf der Karte",
+		"INVALID_TIMESTAMP": "Ungültiger Zeitstempel",
+		"TIMESTAMP_NOT_ALLOWED": "Zeitstempel dürfen nur von Administratoren angegeben werden",
+		"INVALID_QUERY_TIMEOUT": "Ungültiges Zeitlimit für Datenbankabfragen",
+		"SHARING_DISABLED": "Teilen von Favoriten ist deaktiviert",
+		"INVALID_SHARE_TOKEN": "Ungültiger oder abgelaufener Freigabelink",
+		"NOT_FAVORITE": "Favorit nicht gefunden",
+		"NOTHING_TO_UNDO": "Es gibt nichts rückgängig zu machen",
+		"UNDO_CONFLICT": "Der Favorit wurde seit der Aktion geändert",
+		"CLIENT_ID_CONFLICT": "Die Client-Kennung wird bereits verwendet",
+		"DB_UNAVAILABLE": "Datenbank nicht verfügbar",
+		"INTERNAL_ERROR": "Interner Serverfehler",
+		"RENDER_FAILED": "Darstellung der Favoriten fehlgeschlagen",
+		"STORE_NOT_READY": "Die Datenbank wird vorbereitet",
+		"DRAINING": "Der Server wird heruntergefahren",
+		"WRITES_PAUSED": "Änderungen sind wegen Wartung pausiert",
+		"TOO_MANY_REQUESTS": "Zu viele gleichzeitige Anfragen"},
+}
+
+// ---
+// Returns primary subtag of the language with a catalog most preferred in
+// "Accept-Language" header value, or an empty string for English.
+func negotiateLanguage(acceptLanguage string) string {
+	selected, selectedPreference := "", 0.0
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag, parameters, _ := strings.Cut(part, ";")
+		preference := 1.0
+
+		if value, found := strings.CutPrefix(strings.TrimSpace(parameters), "q="); found {
+			parsedValue, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+
+			preference = parsedValue
+		}
+
+		language, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(tag)), "-")
+		if preference <= selectedPreference {
+			continue
+		}
+
+		if errorCatalogs[language] != nil || language == "en" {
+			selected, selectedPreference = language, preference
+		}
+	}
+
+	if selected == "en" {
+		return ""
+	}
+
+	return selected
+}
+
+// ---
+// Wraps response writer to carry language negotiated for the request, which
+// writeError finds by unwrapping writers of middleware.
+type localizingWriter struct {
+	http.ResponseWriter
+	language string
+}
+
+// ---
+func (writer *localizingWriter) Unwrap() http.ResponseWriter {
+	return writer.ResponseWriter
+}
+
+// ---
+// Returns handler making error messages use the language preferred by client.
+func withLocalization(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Add("Vary", "Accept-Language")
+
+		language := negotiateLanguage(request.Header.Get("Accept-Language"))
+		if language == "" {
+			handler.ServeHTTP(response, request)
+			return
+		}
+
+		handler.ServeHTTP(&localizingWriter{ResponseWriter: response, language: language}, request)
+	})
+}
+
+// ---
+// Returns message of error code in language negotiated for response and the
+// language, or the provided English message and an empty string if there's no
+// translation.
+func localizeError(response http.ResponseWriter, code errorCode, message string) (string, string) {
+	for {
+		if writer, found := response.(*localizingWriter); found {
+			if translation, found := errorCatalogs[writer.language][code.name]; found {
+				return translation, writer.language
+			}
+
+			return message, ""
+		}
+
+		wrapper, found := response.(interface{ Unwrap() http.ResponseWriter })
+		if !found {
+			return message, ""
+		}
+
+		response = wrapper.Unwrap()
+	}
+}
@@ -0,0 +1,47 @@
+// JSON:API representation of favorites, used for clients requesting it using
+// the "Accept" header.
+
+package main
+
+import (
+	"net/http"
+	"encoding/json"
+)
+
+type jsonAPIResource struct {
+	Type string `json:"type"`
+	ID string `json:"id"`
+	Attributes map[string]string `json:"attributes"`
+}
+
+// ---
+// Favorites are listed as distinct drinks, which is why the drink name is used
+// as resource identifier rather than identifiers of individual rows. Pages are
+// linked by relation type if paginated, with the cursor of the next page (if
+// any) included in "meta".
+func writeFavoritesJSONAPI(
+	response http.ResponseWriter, selfURL string, pageURLs map[string]string,
+	nextCursor string, favorites []string) {
+
+	resources := []jsonAPIResource{}
+	for _, favorite := range favorites {
+		resources = append(resources, jsonAPIResource{
+			Type: "favorites", ID: favorite, Attributes: map[string]string{"drink": favorite}})
+	}
+
+	links := map[string]string{"self": selfURL}
+	for relation, pageURL := range pageURLs {
+		links[relation] = pageURL
+	}
+
+	meta := map[string]interface{}{"count": len(resources)}
+	if nextCursor != "" {
+		meta["nextCursor"] = nextCursor
+	}
+
+	responseData, _ := json.Marshal(map[string]interface{}{
+		"data": resources, "links": links, "meta": meta})
+
+	response.Header().Set("Content-Type", "application/vnd.api+json")
+	response.Write(responseData)
+}
@@ -4,42 +4,443 @@
 //
 // GET /api/favorites/bob : Get favorites for Bob.
 // "Screwdriver" | POST /api/favorites/ada : Add drink as favorite for Ada.
+// {"drink":"Mojito","category":"summer"} | POST /api/favorites/ada : Add drink in category.
+// {"drink":"Negroni","timestamp":"2020-01-01T00:00:00Z"} | POST /api/favorites/ada : Backfill (admin).
+// {"drink":"Mojito","clientId":"<UUID>"} | POST /api/favorites/ada : Add drink idempotently.
+// "Mojito" | POST /api/favorites/ada (Prefer: return=minimal) : Add drink, respond without body.
+// GET /api/favorites/ada?category=summer : Get favorites for Ada in category "summer".
+// GET /api/favorites/ada?from=2025-01-01T00:00:00Z&to=2025-02-01T00:00:00Z : Get favorites added in January.
+// GET /api/favorites/ada?limit=50&offset=100 : Get page of favorites for Ada ordered by drink.
+// GET /api/favorites/ada?limit=50&after=Negroni : Get page of favorites for Ada after "Negroni".
+// GET /api/favorites/ada?limit=50&cursor= : Get first page with "nextCursor" in the response body.
+// GET /api/favorites/ada?limit=50&cursor=TmVncm9uaQ : Get next page using cursor of previous page.
+// GET /api/favorites/ada?format=html : Get favorites for Ada as HTML page.
+// GET /api/favorites/ada (Accept: application/hal+json) : Get favorites for Ada in HAL format.
+// GET /api/favorites/ada (Accept: application/vnd.api+json) : Get favorites for Ada in JSON:API format.
+// GET /api/favorites/ada/id/42 : Get favorite of Ada with identifier 42.
+// GET /api/favorites/ada/categories : Get categories used by Ada.
+// GET /api/favorites/ada/recommendations?limit=5 : Get drinks favorited by users with similar taste.
+// GET /api/favorites/ada/rank?drink=Negroni : Get how early Ada favorited "Negroni" among all users.
+// GET /api/favorites/ada/streak : Get current and longest streak of days Ada added favorites.
+// GET /api/favorites/ada/share : Get time-limited link for viewing favorites of Ada.
+// GET /s/TOKEN : View shared favorites as HTML page (no access key required).
+// {"drink":"Mojito","category":"party"} | PATCH /api/favorites/ada/category : Move favorite.
+// POST /api/favorites/ada/undo : Undo the last favorite addition made by Ada.
+// GET /api/favorites/bob/grouped : Get favorites for Bob grouped by first letter.
+// GET /api/common?users=ada,bob : Get drinks favorited by both Ada and Bob.
+// GET /api/diff?base=ada&other=bob : Compare favorites of Ada with those of Bob.
+// GET /api/count?user=ada&drink=Negroni : Count favorites of Negroni added by Ada.
+// GET /api/count?since=2025-01-01T00:00:00Z : Count all favorites added since time (requires admin key).
+// GET /api/auth/check : Verify that access key is valid, without accessing the database.
+// GET /api/drinks?prefix=ne&limit=10 : Get most favorited drinks starting with "ne".
 // GET / : Health/Readiness end-point.
+// GET /api/health : Health of server and its dependencies in JSON format.
+// GET /api/health/deep : Health of database write path in JSON format (requires admin key).
+// GET /api/admin/schema : Get columns of favorites table (requires admin key).
+// GET /api/stats/active?since=2025-01-01T00:00:00Z : Get users active since time (requires admin key).
+// GET /api/stats/users/activity?limit=100&offset=0 : Get first/last activity per user (requires admin key).
+// DELETE /api/admin/prune?olderThan=90d : Delete favorites older than 90 days (requires admin key).
+// DELETE /api/admin/all?confirm=true : Delete all favorites (requires admin key).
+// {"writesEnabled":false} | POST /api/admin/maintenance : Pause writes (requires admin key).
+// GET /api/admin/maintenance : Get whether writes are enabled (requires admin key).
+// GET /metrics : Prometheus metrics, such as "favorites_database_writes_total".
+// GET /debug/vars : Counters in expvar format (if enabled).
 //
-// Listens for HTTP on port 8000/TCP by default.
+// Listens for HTTP on port 8000/TCP by default. If "APP_ADMIN_ADDRESS" is set,
+// health end-points ("/", "/api/health", "/api/health/deep", "/metrics" and
+// "/debug/vars") are only served on the admin address while the favorites API
+// is only served on port 8000/TCP.
+// Servers are gracefully shut down upon receiving SIGINT or SIGTERM. While
+// draining, health end-points respond with status 503 and "/api/health" reports
+// number of API requests still in flight (if served on the admin address).
+// The database table is created in the background after startup, retrying if
+// the database isn't reachable yet. Until then, API requests are rejected with
+// status 503 and health end-points report the server as not ready.
+// Concurrent identical requests for listing favorites share a single query.
+// Listed favorites include the rqlite consistency level used for reading them
+// in the "X-DB-Consistency" header, which is "none" if read from a replica.
+// The "X-Data-Freshness" header additionally includes when the read was made,
+// such as "none; read-at=2025-01-01T00:00:00Z". Reads at consistency "strong"
+// reflect all writes acknowledged before that time. Reads at "none" may lag
+// behind by the replication delay of the replica, which rqlite doesn't report.
+// The client library doesn't expose Raft indexes, so they aren't included.
+// While writes are paused for maintenance, requests other than GET, HEAD and
+// OPTIONS are rejected with status 503 and a "Retry-After" header. Pausing is
+// per server instance, so requests should be sent to every replica.
+// Full pages of paginated end-points include an opaque cursor for fetching the
+// next page in the "X-Next-Cursor" header, to be passed as "cursor" query
+// parameter. The cursor is also included as "nextCursor" in HAL objects and in
+// the "meta" object of JSON:API documents. Passing "cursor" (empty for the
+// first page) responds with an object such as {"favorites":[...],"nextCursor":
+// "..."} instead of a plain JSON array, omitting "nextCursor" on the last page.
+// Prefer cursors over "offset" for new clients, as pages stay consistent when
+// favorites are added concurrently and deep pages are cheaper. Offsets are only
+// kept for backward compatibility, and are limited by APP_MAX_PAGINATION_OFFSET.
+// Paginated responses also include "Link" headers with URLs (including the path
+// prefix, if any) of the first, previous and next pages.
+// Errors are responded to with a JSON object containing a stable error code
+// and a human-readable message, such as {"code":"DB_UNAVAILABLE","error":
+// "Failed to query database"}. Codes are listed in errors.go. Messages are
+// translated to the language preferred in the "Accept-Language" header if
+// available (currently Swedish and German), see i18n.go for adding languages.
+// End-points returning lists respond with a JSON array (unless cursor
+// pagination is requested, see above), which is empty ("[]") rather than
+// "null" if there are no results.
+// Added favorites are returned as JSON with status 201, unless the client sends
+// "Prefer: return=minimal" in which case the response body is empty. Invalid
+// submissions are rejected with status 400 and a list of all problems found,
+// such as [{"field":"category","message":"..."}], in the error response. If a
+// unique constraint on user and drink has been added to the database, adding
+// an existing favorite is ignored and responded to with status 200 and a body
+// such as {"drink":"Negroni","alreadyFavorited":true}, as are duplicates
+// collapsed by "APP_DEDUP_WINDOW".
 // Settings configurable using environment variables:
 //
 // "APP_ACCESS_KEY":
-// Simple key/token used for authenticating client requests.
+// Simple key/token used for authenticating client requests, which provide it
+// using the "X-Access-Key" header. For GET requests of favorites in HTML format,
+// it may instead be provided using the "key" query parameter to enable viewing
+// in browsers. Beware that keys in URLs may leak through browser history,
+// access logs and "Referer" headers.
+//
+// "APP_READONLY_ACCESS_KEY":
+// Key that may be provided like "APP_ACCESS_KEY", but only permits GET and
+// HEAD requests. Other requests using it are rejected with status 403.
+// Optional.
+//
+// "APP_DEFAULT_USER":
+// User whose favorites are accessed if no username is specified in the URL
+// path (such as "/api/favorites/"), intended for single-user deployments.
+// Requests without username are rejected if unset. Optional.
+//
+// "APP_SHARE_SECRET":
+// Secret of at least 32 characters used for signing tokens of links to shared
+// favorites. Anyone with a valid link may view (but not modify) favorites of
+// the user until the link expires; links can't be revoked before that, except
+// by changing the secret. Sharing is disabled if unset. Optional.
+//
+// "APP_SHARE_TTL":
+// Duration for which links to shared favorites are valid, defaults to "15m".
 //
 // "APP_DATABASE_URL":
 // HTTP or HTTPS connection URL to rqlite database.
 //
+// "APP_DATABASE_READ_URL":
+// HTTP or HTTPS connection URL to rqlite read replica, used for listing
+// queries while writes use "APP_DATABASE_URL". Reads from the replica use
+// consistency level "none" and may therefore return slightly stale data, such
+// as not yet including a favorite that was just added. Falls back to the
+// primary database if the replica is unreachable. Optional.
+//
+// "APP_DATABASE_SHADOW_URL":
+// HTTP or HTTPS connection URL to a second rqlite database which successful
+// writes are mirrored to, for use while migrating between clusters. Mirroring
+// is asynchronous and failures are only logged and counted by the
+// "favorites_shadow_write_failures_total" metric, so the shadow database is
+// eventually consistent at best and may miss writes. Statements are mirrored
+// rather than rows, so generated identifiers differ between the databases.
+// Timestamps of added favorites are therefore set by the server rather than the
+// database while mirroring, enabling favorites deleted by identifier (such as
+// when undoing) to be matched by user, drink and timestamp in the shadow
+// database. Reads only use the primary database. Optional.
+//
+// "APP_DATABASE_HEADERS":
+// Comma-separated list of "Name:Value" pairs added as headers to all requests
+// to rqlite, such as "X-Proxy-Token:secret" for authentication schemes of
+// proxies in front of the database. Header values are not logged. Optional.
+//
 // "APP_DATABASE_USER":
-// Username for database connection.
+// Username for database connection, also used for the read replica.
 //
 // "APP_DATABASE_PASSWORD":
-// Password for database connection.
+// Password for database connection, must be set if "APP_DATABASE_USER" is set
+// and vice versa.
+//
+// "APP_DATABASE_SHADOW_USER" and "APP_DATABASE_SHADOW_PASSWORD":
+// Credentials for the shadow database connection, which don't default to those
+// of the primary database. Like for the primary database, both or neither must
+// be set. Credentials may instead be included in "APP_DATABASE_SHADOW_URL".
+//
+// "APP_ADMIN_ACCESS_KEY":
+// Key/token used for authenticating administrative requests, which
+// provide it using the "X-Admin-Key" header. Administrative clients may also
+// access favorites of any user without providing "X-Access-Key", which is
+// logged for added favorites. Optional.
+//
+// "APP_BACKFILL_MAX_SKEW":
+// Maximum duration that timestamps of backfilled favorites may be in the
+// future, allowing for clock skew between clients and server. Defaults to "1m".
+//
+// "APP_DB_QUEUED_WRITES":
+// Add favorites using queued writes if "true", which rqlite batches and applies
+// asynchronously for higher throughput. Such requests are responded to with
+// status 202 and an empty body before the favorite is durably stored, so
+// favorites may be lost if the database fails and errors (such as constraint
+// violations) aren't reported to clients. Queued favorites can't be undone.
+// Defaults to "false", using synchronous strongly consistent writes.
+//
+// "APP_DATABASE_TIMEOUT":
+// Default timeout for database queries, defaults to "5s".
+//
+// "APP_DATABASE_MAX_TIMEOUT":
+// Ceiling for query timeouts requested by administrative clients using the
+// "X-Query-Timeout" header (such as "45s"). Must not exceed (and defaults to)
+// "APP_REQUEST_TIMEOUT", as requests are aborted after it regardless.
+//
+// "APP_SLOW_QUERY_MS":
+// Log a warning for database calls taking longer than the specified number of
+// milliseconds. Disabled by default.
+//
+// "APP_CASE_INSENSITIVE_USERS":
+// Treat usernames differing only by case as the same user if "true". Usernames
+// are lowercased when favorites are added and compared case-insensitively when
+// favorites are read. Enabling it for a database with existing mixed-case
+// usernames requires a one-time normalization, such as running
+// 'UPDATE favorites SET user = LOWER(user)'. Defaults to "false".
+//
+// "APP_RECIPES_URL":
+// HTTP or HTTPS URL to recipes API server, which health is included as a
+// non-critical check by "/api/health" if set. Optional.
+//
+// "APP_SEED_DATA":
+// Populate an empty database with sample favorites for users such as "ada" and
+// "bob" during startup if "true". Intended for demos/development only, defaults
+// to "false".
+//
+// "APP_DEDUP_WINDOW":
+// Identical favorite additions (same user and drink) received within the
+// specified duration are collapsed into one, defaults to "2s". Set to "0s" to
+// disable. Backfilled favorites (with explicit timestamp) aren't collapsed.
+//
+// "APP_HEALTH_QUERY":
+// Query used by health-checks to verify that the database is usable, such as
+// "SELECT id FROM favorites LIMIT 1" to also verify that the table exists. It
+// must be read-only and fast, as it's run for every health-check. Defaults to
+// "SELECT 1".
+//
+// "APP_DATABASE_WRITE_ATTEMPTS":
+// Maximum number of attempts for database writes failing due to transient
+// errors (such as a change of cluster leader), defaults to "3". Additions of
+// favorites are only retried if the database is known not to have applied them.
+//
+// "APP_DATABASE_STARTUP_ATTEMPTS":
+// Maximum number of attempts for creating the favorites table during startup,
+// enabling the server to start before the database is reachable. The server
+// exits if all attempts fail. Defaults to "10".
+//
+// "APP_DATABASE_BACKOFF_BASE" and "APP_DATABASE_BACKOFF_CAP":
+// Base and maximum delay between retried database operations, which grows
+// exponentially per attempt and is randomized to avoid synchronized retries
+// from many replicas ("full jitter"). Defaults to "100ms" and "5s".
+//
+// "APP_IDS_AS_STRINGS":
+// Return identifiers of favorites as strings rather than numbers in JSON
+// responses if "true". JavaScript represents numbers as 64-bit floats, so
+// identifiers above 2^53 would silently lose precision when parsed by such
+// clients. Defaults to "false".
+//
+// "APP_DRINK_ALIASES":
+// Aliases for drink names, which are replaced by the canonical name before
+// favorites are stored. Either a JSON object mapping alias to canonical name
+// (such as '{"OJ Vodka": "Screwdriver"}') or path to a file containing one.
+// Aliases are matched case-insensitively. Optional.
+//
+// "APP_ALLOWED_DRINKS":
+// Drinks which may be added as favorites, others are rejected with status 422.
+// Either a comma-separated list or path (starting with "/" or ".") to a file
+// listing one drink per line. Drinks are matched case-insensitively after
+// aliases are applied. Defaults to allowing any drink.
+//
+// "APP_AUTOCOMPLETE_MAX":
+// Maximum number of drinks returned by "/api/drinks", larger requested limits
+// are lowered to it. Defaults to "20".
+//
+// "APP_WARMUP":
+// Run trivial queries against the database (and read replica) on startup if
+// "true", establishing connections before traffic is served to avoid slow
+// first requests. Defaults to "false".
+//
+// "APP_WARMUP_QUERIES":
+// Number of concurrent warm-up queries per database connection if
+// "APP_WARMUP" is enabled, defaults to "4".
+//
+// "APP_METRICS_DRINKS":
+// Comma-separated list of drinks used as label values for the
+// "favorites_added_total" metric. Other drinks are counted as "other", which
+// keeps metric cardinality bounded despite drinks being submitted by clients.
+// If unset, the first drinks observed are used as label values.
+//
+// "APP_METRICS_MAX_DRINKS":
+// Maximum number of drinks used as label values if "APP_METRICS_DRINKS" is
+// unset, defaults to "50".
+//
+// "APP_ENABLE_DEBUG":
+// Expose counters for requests, server errors and database calls in Go's
+// expvar format on "/debug/vars" if "true". Defaults to "false".
+//
+// "APP_DEBUG_LOG_BODIES":
+// Log headers and bodies of API requests and responses if "true", intended
+// for diagnosing client issues. Access keys are redacted, but beware that
+// logs will contain personal information such as usernames and favorites.
+// Defaults to "false".
+//
+// "APP_DEBUG_LOG_BODY_LIMIT":
+// Maximum number of bytes logged per body if "APP_DEBUG_LOG_BODIES" is
+// enabled, longer bodies are truncated. Defaults to "1024".
+//
+// "APP_MAX_HEADER_BYTES":
+// Maximum size of request headers in bytes, larger requests are rejected.
+// Defaults to "1048576" (1 MB).
+//
+// "APP_MAX_BODY_BYTES":
+// Maximum size of request bodies to the favorites API. Bodies compressed using
+// gzip ("Content-Encoding: gzip") are decompressed transparently, with the
+// limit applying to the decompressed size. Larger bodies are rejected with
+// status 413. Defaults to "1048576" (1 MB).
+//
+// "APP_REQUEST_TIMEOUT":
+// Maximum duration for handling a request before responding with status 503,
+// defaults to "30s".
+//
+// "APP_MAX_CONNS_PER_IP":
+// Maximum number of concurrent connections per client IP address, further
+// connections are closed when accepted. Connections from proxies listed in
+// "APP_TRUSTED_PROXIES" aren't limited, as they are shared by many clients.
+// Instead, concurrent requests through them are limited per client address in
+// the "X-Forwarded-For" header, rejecting further requests with status 429.
+// Without trusted proxies, clients behind a proxy or load balancer share its
+// limit. Defaults to "0" (unlimited).
+//
+// "APP_TRUSTED_PROXIES":
+// Comma-separated IP addresses or CIDR prefixes (such as "10.0.0.0/8") of
+// reverse proxies trusted to set the "X-Forwarded-For" header. Optional.
+//
+// "APP_ENABLE_H2C":
+// Serve the favorites API using cleartext HTTP/2 ("h2c") if "true", enabling
+// multiplexing of requests from clients and service meshes supporting it.
+// HTTP/1.1 clients keep working. Go's HTTP server already negotiates HTTP/2
+// when serving TLS (ListenAndServeTLS), but this server only serves plaintext
+// HTTP. Defaults to "false".
+//
+// "APP_TRAILING_SLASH":
+// Handling of trailing slashes in favorites paths, such as
+// "/api/favorites/bob/grouped/". Either "strip" to treat them as if the slash
+// was absent, or "redirect" to respond with status 308 and the path without
+// slash in the "Location" header. Defaults to "strip".
+//
+// "APP_MAX_PAGINATION_OFFSET":
+// Maximum value of the "offset" query parameter of paginated end-points, as
+// rows before the offset are scanned and discarded by the database. Deeper
+// pages are fetched using "after" with the last result of the previous page
+// (such as a drink name) instead, which filters out earlier rows by comparison
+// rather than counting them. Defaults to "10000".
+//
+// "APP_COMPRESSION":
+// Comma-separated compression algorithms ("gzip" and "zstd") which may be used
+// for responses of the favorites API, or "none" to disable compression. The
+// algorithm most preferred by the client in "Accept-Encoding" is used, with
+// ties broken by order in the list. Defaults to "gzip".
+//
+// "APP_MAINTENANCE_SCHEDULE":
+// Comma-separated maintenance windows during which writes are disabled, each
+// specified as start and end time (RFC3339) separated by a slash, such as
+// "2025-01-01T02:00:00Z/2025-01-01T04:00:00Z". Requests modifying favorites
+// are rejected with status 503 and "Retry-After" set to the end of the window,
+// which is also reported as "maintenanceUntil" by "/api/health". Optional.
+//
+// "APP_ADMIN_ADDRESS":
+// Listen address (such as ":8001") for a dedicated server providing health
+// end-points, intended to be internal-only. Optional.
+//
+// "APP_PATH_PREFIX":
+// Path prefix (such as "/favorites-service") the favorites API is served under,
+// for use behind a shared ingress. It's stripped from request paths before
+// routing and added to URLs in responses, requests without it are responded to
+// with status 404. Health end-points are only served under the prefix if
+// "APP_ADMIN_ADDRESS" is unset. Defaults to serving at the root.
 
 package main
 
 import (
 	"os"
+	"expvar"
+	"syscall"
+	"os/signal"
 	"log"
 	"fmt"
+	"time"
+	"sort"
+	"math"
+	"errors"
+	"unicode"
+	"sync/atomic"
+	"context"
 	"strings"
+	"strconv"
+	"net"
 	"net/http"
 	"net/url"
 	"io/ioutil"
+	"crypto/subtle"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/base64"
 	"github.com/rqlite/gorqlite"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.org/x/sync/singleflight"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-var accessKey, databaseURL, databaseUser, databasePassword, hostString string
-var databaseConnection *gorqlite.Connection
+// Holds configuration and dependencies used by HTTP handlers.
+type favoritesServer struct {
+	config Config
+	store Store
+	hostString string
+	deduplicator *deduplicator
+	drinkLabeler *drinkLabeler
+	undoHistory *undoHistory
+
+	// Set during maintenance to reject requests modifying favorites.
+	writesPaused atomic.Bool
+
+	// Set once the database has been prepared, API requests are rejected until then.
+	storeReady atomic.Bool
+
+	// Coalesces concurrent identical queries for listing favorites.
+	listGroup singleflight.Group
+
+	// Set once shutdown begins, making readiness checks fail while in-flight
+	// API requests are finished.
+	draining atomic.Bool
+	inFlightRequests atomic.Int64
+}
+
+// ---
+// Returns URL with password (if any) replaced by "****", suitable for logging.
+func redactURL(rawURL string) string {
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil {
+		return "[unparsable URL redacted]"
+	}
+
+	if _, hasPassword := parsedURL.User.Password(); !hasPassword {
+		return parsedURL.String()
+	}
+
+	// Asterisks are percent-encoded in userinfo, which is undone for readability
+	parsedURL.User = url.UserPassword(parsedURL.User.Username(), "****")
+	return strings.Replace(parsedURL.String(), ":%2A%2A%2A%2A@", ":****@", 1)
+}
 
 // ---
-func init() {
+// Returns server using specified configuration and storage backend.
+func newFavoritesServer(config Config, store Store) *favoritesServer {
+	server := &favoritesServer{
+		config: config, store: store, undoHistory: newUndoHistory(10000),
+		drinkLabeler: newDrinkLabeler(config.MetricsDrinks, config.MetricsMaxDrinks)}
+
 	hostName, err := os.Hostname()
 	if err != nil {
 		log.Fatal("Failed to get hostname for running system")
@@ -47,37 +448,35 @@ func init() {
 
 	kubernetesNodeName := os.Getenv("K8S_NODE_NAME")
 	if kubernetesNodeName != "" {
-		hostString = fmt.Sprintf("pod %s on node %s", hostName, kubernetesNodeName)
+		server.hostString = fmt.Sprintf("pod %s on node %s", hostName, kubernetesNodeName)
 
 	} else {
-		hostString = "host " + hostName
+		server.hostString = "host " + hostName
 	}
-	
-	accessKey = os.Getenv("APP_ACCESS_KEY")
-	databaseURL = os.Getenv("APP_DATABASE_URL")
-	databaseUser = os.Getenv("APP_DATABASE_USER")
-	databasePassword = os.Getenv("APP_DATABASE_PASSWORD")
 
-	if accessKey == "" || databaseURL == "" {
-		log.Fatal("Environment variable APP_ACCESS_KEY or APP_DATABASE_URL missing")
+	if config.DedupWindow > 0 {
+		server.deduplicator = newDeduplicator(config.DedupWindow, 10000)
 	}
 
-	if databaseUser != "" && databasePassword != "" {
-		log.Print("Reading username/password from dedicated environment variables")
-		
-		parsedDatabaseURL, err := url.Parse(databaseURL)
-		if err != nil {
-			log.Fatal("Failed to parse database connection URL: ", databaseURL)
-		}
+	return server
+}
 
-		parsedDatabaseURL.User = url.UserPassword(databaseUser, databasePassword)
-		databaseURL = parsedDatabaseURL.String()
+// ---
+// Opens connection to rqlite database and prepares it for use.
+func openStore(config Config) *rqliteStore {
+	databaseClient := newDatabaseClient(config.DatabaseHeaders)
+	for name := range config.DatabaseHeaders {
+		// Values are not logged as headers are likely to contain credentials
+		log.Printf("Adding header \"%s\" to database requests", name)
 	}
 
-	log.Print("Opening connection to rqlite database")
-	databaseConnection, err = gorqlite.Open(databaseURL)
+	log.Print("Opening connection to rqlite database at ", redactURL(config.DatabaseURL))
+	databaseConnection, err := gorqlite.OpenWithClient(config.DatabaseURL, databaseClient)
 	if err != nil {
-		log.Fatal("Failed to open database connection: ", err)
+		log.Fatal(
+			"Failed to open database connection: ",
+			strings.ReplaceAll(
+				err.Error(), config.DatabaseURL, redactURL(config.DatabaseURL)))
 	}
 
 	err = databaseConnection.SetConsistencyLevel(gorqlite.ConsistencyLevelStrong)
@@ -85,150 +484,2615 @@ func init() {
 		log.Fatal("Failed to configure database consistency level: ", err)
 	}
 
-	writeResult, err := databaseConnection.WriteOne(`
-		CREATE TABLE IF NOT EXISTS "favorites"
-		("id" INTEGER, "timestamp" DATETIME DEFAULT CURRENT_TIMESTAMP,
-		"user" TEXT, "drink" TEXT, PRIMARY KEY ("id" AUTOINCREMENT))`)
+	rqliteStore := newRqliteStore(databaseConnection)
 
-	if err != nil || writeResult.Err != nil {
-		log.Fatalf(
-			"Failed to create database table for favorites: \"%s\", \"%s\"",
-			err, writeResult.Err)
+	if config.DatabaseReadURL != "" {
+		log.Print(
+			"Opening connection to rqlite read replica at ", redactURL(config.DatabaseReadURL))
+
+		rqliteStore.readConnection, err = gorqlite.OpenWithClient(
+			config.DatabaseReadURL, databaseClient)
+
+		if err != nil {
+			log.Fatal(
+				"Failed to open read replica connection: ",
+				strings.ReplaceAll(
+					err.Error(), config.DatabaseReadURL, redactURL(config.DatabaseReadURL)))
+		}
+
+		err = rqliteStore.readConnection.SetConsistencyLevel(gorqlite.ConsistencyLevelNone)
+		if err != nil {
+			log.Fatal("Failed to configure read replica consistency level: ", err)
+		}
 	}
 
-	return
+	if config.DatabaseShadowURL != "" {
+		log.Print(
+			"Opening connection to rqlite shadow database at ",
+			redactURL(config.DatabaseShadowURL))
+
+		shadowConnection, err := gorqlite.OpenWithClient(
+			config.DatabaseShadowURL, databaseClient)
+
+		if err != nil {
+			log.Fatal(
+				"Failed to open shadow database connection: ",
+				strings.ReplaceAll(
+					err.Error(), config.DatabaseShadowURL, redactURL(config.DatabaseShadowURL)))
+		}
+
+		rqliteStore.shadow = newShadowWriter(shadowConnection, config.DatabaseTimeout, 10000)
+	}
+
+	rqliteStore.writeAttempts = config.DatabaseWriteAttempts
+
+	if config.SlowQueryThreshold > 0 {
+		log.Print("Logging database calls taking longer than ", config.SlowQueryThreshold)
+		rqliteStore.slowQueryThreshold = config.SlowQueryThreshold
+	}
+
+	if config.CaseInsensitiveUsers {
+		log.Print("Treating usernames as case-insensitive")
+		rqliteStore.caseInsensitiveUsers = true
+	}
+
+	if config.HealthQuery != "" {
+		log.Printf("Using custom health-check query \"%s\"", config.HealthQuery)
+		rqliteStore.healthQuery = config.HealthQuery
+	}
+
+	rqliteStore.backoff = backoffPolicy{base: config.BackoffBase, cap: config.BackoffCap}
+	return rqliteStore
 }
 
 // ---
-func healthHandler(response http.ResponseWriter, request *http.Request) {
-	response.Header().Add("X-Provided-By", hostString)
-	
-	if request.Method != "GET" {
-		http.Error(response, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// Creates and migrates table for favorites, retrying while the database isn't
+// reachable. Intended to run in the background while the server reports not
+// being ready, as the database may become reachable after the server starts.
+func prepareStore(config Config, rqliteStore *rqliteStore) {
+	err := retryWithBackoff(
+		"create database table for favorites", config.DatabaseStartupAttempts,
+		rqliteStore.backoff, time.Sleep, func() error {
+			return rqliteStore.CreateTable(context.Background())
+		})
+
+	if err != nil {
+		log.Fatal("Failed to create database table for favorites: ", err)
+	}
+
+	if err := rqliteStore.Migrate(context.Background()); err != nil {
+		log.Fatal("Failed to migrate database table for favorites: ", err)
+	}
+
+	if config.SeedData {
+		seeded, err := rqliteStore.SeedIfEmpty(context.Background())
+		if err != nil {
+			log.Fatal("Failed to seed database with sample favorites: ", err)
+		}
+
+		if seeded {
+			log.Print("SEEDING: Populated empty database with sample favorites")
+		} else {
+			log.Print("Skipping seeding of sample favorites as database is not empty")
+		}
+	}
+
+	if config.WarmupQueries > 0 {
+		log.Printf("Warming up database connections using %d queries", config.WarmupQueries)
+		ctx, cancel := context.WithTimeout(context.Background(), config.DatabaseTimeout)
+		defer cancel()
+
+		// Failures only affect latency of the first requests, so they aren't fatal
+		if err := rqliteStore.Warmup(ctx, config.WarmupQueries); err != nil {
+			log.Print("Failed to warm up database connections: ", err)
+		}
+	}
+}
+
+// ---
+// Prepares store in the background, accepting API requests once it's done.
+func (server *favoritesServer) prepareStoreInBackground(rqliteStore *rqliteStore) {
+	go func() {
+		prepareStore(server.config, rqliteStore)
+		log.Print("Database is prepared, accepting favorites API requests")
+		server.storeReady.Store(true)
+	}()
+}
+
+// ---
+// Returns whether key grants access to the favorites API and whether that
+// access is limited to reading. Keys are compared in constant time.
+func (server *favoritesServer) checkAccessKey(key string) (bool, bool) {
+	if subtle.ConstantTimeCompare([]byte(key), []byte(server.config.AccessKey)) == 1 {
+		return true, false
+	}
+
+	readOnlyKey := server.config.ReadOnlyAccessKey
+	if readOnlyKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(readOnlyKey)) == 1 {
+		return true, true
 	}
 
-	queryRows, err := databaseConnection.QueryOne("SELECT id FROM favorites")
-	if err != nil || queryRows.Err != nil {
+	return false, false
+}
+
+// ---
+func (server *favoritesServer) isAdminRequest(request *http.Request) bool {
+	adminKey := server.config.AdminKey
+	return adminKey != "" && subtle.ConstantTimeCompare(
+		[]byte(request.Header.Get("X-Admin-Key")), []byte(adminKey)) == 1
+}
+
+// ---
+// Returns description of administrator making request for logging, including
+// client address and a fingerprint (hash prefix) of the admin key, which
+// identifies the key without revealing it.
+func (server *favoritesServer) adminIdentity(request *http.Request) string {
+	keyHash := sha256.Sum256([]byte(server.config.AdminKey))
+	return fmt.Sprintf(
+		"administrator at \"%s\" with key fingerprint \"%s\"",
+		clientIP(request, server.config.TrustedProxies), hex.EncodeToString(keyHash[:4]))
+}
+
+// ---
+// Logs addition of favorite, identifying the administrator if made on behalf
+// of the user.
+func (server *favoritesServer) logFavoriteAddition(
+	request *http.Request, user string, drink string) {
+
+	if server.isAdminRequest(request) {
 		log.Printf(
-			"Failed query database during health-check: \"%s\", \"%s\"",
-			err, queryRows.Err)
+			"Adding drink \"%s\" as favorite on behalf of user \"%s\" as requested by %s",
+			drink, user, server.adminIdentity(request))
 
-		http.Error(response, "Database unavailable", http.StatusInternalServerError)
 		return
 	}
 
-	response.Write(
-		[]byte(fmt.Sprintf("Hello from favorites API server on %s!\n", hostString)))
+	log.Printf("Adding drink \"%s\" as favorite for user \"%s\"", drink, user)
+}
 
-	return
+// ---
+// Returns context used for database queries, which is canceled if the client
+// disconnects and which timeout may be overridden by administrative clients
+// using the "X-Query-Timeout" header up to a hard ceiling.
+func (server *favoritesServer) databaseContext(
+	request *http.Request) (context.Context, context.CancelFunc, error) {
+
+	timeout := server.config.DatabaseTimeout
+	requestedTimeout := request.Header.Get("X-Query-Timeout")
+
+	if requestedTimeout != "" && server.isAdminRequest(request) {
+		parsedTimeout, err := time.ParseDuration(requestedTimeout)
+		if err != nil || parsedTimeout <= 0 {
+			return nil, nil, fmt.Errorf("invalid query timeout \"%s\"", requestedTimeout)
+		}
+
+		if parsedTimeout > server.config.DatabaseMaxTimeout {
+			return nil, nil, fmt.Errorf(
+				"query timeout \"%s\" exceeds ceiling of %s",
+				requestedTimeout, server.config.DatabaseMaxTimeout)
+		}
+
+		log.Printf("Using query timeout of %s requested by administrative client", parsedTimeout)
+		timeout = parsedTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(request.Context(), timeout)
+	return ctx, cancel, nil
 }
 
 // ---
-func favoritesHandler(response http.ResponseWriter, request *http.Request) {
-	response.Header().Add("X-Provided-By", hostString)
+func (server *favoritesServer) healthHandler(response http.ResponseWriter, request *http.Request) {
+	response.Header().Add("X-Provided-By", server.hostString)
 	
-	if request.Method != "GET" && request.Method != "POST" {
-		http.Error(response, "Method not allowed", http.StatusMethodNotAllowed)
+	if request.Method != "GET" {
+		writeError(response, errorMethodNotAllowed, "Method not allowed")
 		return
 	}
 
-	if request.Header.Get("X-Access-Key") != accessKey {
-		log.Print("Received favorites request with incorrect access key")
-		http.Error(response, "Invalid access key", http.StatusUnauthorized)
+	if server.draining.Load() {
+		writeError(response, errorDraining, "Server is shutting down")
 		return
 	}
 
-	user := strings.TrimPrefix(request.URL.Path, "/api/favorites/")
-	if user == "" {
-		log.Print("Received favorites request without target user specified")
-		http.Error(response, "URL path missing username", http.StatusBadRequest)
+	if !server.storeReady.Load() {
+		writeError(response, errorStoreNotReady, "Database is being prepared")
 		return
 	}
 
-	if request.Method == "GET" {
-		log.Printf("Returning list of favorites for user \"%s\"", user)
+	ctx, cancel := context.WithTimeout(request.Context(), server.config.DatabaseTimeout)
+	defer cancel()
 
-		queryRows, err := databaseConnection.QueryOneParameterized(
-			gorqlite.ParameterizedStatement{
-				Query: "SELECT DISTINCT drink FROM favorites WHERE user = ?",
-				Arguments: []interface{}{user},},)
+	if err := server.store.Ping(ctx); err != nil {
+		log.Print("Failed query database during health-check: ", err)
 
-		if err != nil || queryRows.Err != nil {
-			log.Printf(
-				"Failed query database for user \"%s\" favorites: \"%s\", \"%s\"",
-				user, err, queryRows.Err)
+		writeError(response, errorDatabaseUnavailable, "Database unavailable")
+		return
+	}
+
+	response.Write(
+		[]byte(fmt.Sprintf("Hello from favorites API server on %s!\n", server.hostString)))
+
+	return
+}
+
+// ---
+type healthCheck struct {
+	Status string `json:"status"`
+	LatencyMs *int64 `json:"latencyMs,omitempty"`
+}
+
+// ---
+// Executes check function and returns its status and latency.
+func runHealthCheck(check func() error) (healthCheck, error) {
+	started := time.Now()
+	err := check()
+	latencyMs := time.Since(started).Milliseconds()
+
+	if err != nil {
+		return healthCheck{Status: "failed", LatencyMs: &latencyMs}, err
+	}
+
+	return healthCheck{Status: "ok", LatencyMs: &latencyMs}, nil
+}
 
-			http.Error(
-				response, "Failed to query database", http.StatusInternalServerError)
+// ---
+// Returns overall health and a breakdown per dependency. Database failures
+// result in status "down", while failing non-critical dependencies (such as the
+// recipes API) result in status "degraded".
+func (server *favoritesServer) healthJSONHandler(
+	response http.ResponseWriter, request *http.Request) {
+
+	response.Header().Add("X-Provided-By", server.hostString)
+
+	if request.Method != "GET" {
+		writeError(response, errorMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	status := "ok"
+	checks := map[string]healthCheck{}
+
+	ctx, cancel := context.WithTimeout(request.Context(), server.config.DatabaseTimeout)
+	defer cancel()
 
-        	return
+	if !server.storeReady.Load() {
+		checks["database"] = healthCheck{Status: "preparing"}
+		status = "down"
+
+	} else {
+		databaseCheck, err := runHealthCheck(func() error { return server.store.Ping(ctx) })
+		checks["database"] = databaseCheck
+		if err != nil {
+			log.Print("Failed query database during health-check: ", err)
+			status = "down"
 		}
-		
-		favorites := []string{}
-		for queryRows.Next() {
-			var favorite string
+	}
+
+	if server.config.RecipesURL == "" {
+		checks["recipes"] = healthCheck{Status: "skipped"}
+
+	} else {
+		recipesCheck, err := runHealthCheck(func() error {
+			recipesRequest, err := http.NewRequestWithContext(ctx, "GET", server.config.RecipesURL, nil)
+			if err != nil {
+				return err
+			}
+
+			recipesResponse, err := http.DefaultClient.Do(recipesRequest)
+			if err != nil {
+				return err
+			}
 
-			if err := queryRows.Scan(&favorite); err != nil {
-				log.Print("Failed to query database for favorites: ", err)
-				http.Error(
-					response, "Failed to query database", http.StatusInternalServerError)
+			defer recipesResponse.Body.Close()
+			if recipesResponse.StatusCode != http.StatusOK {
+				return fmt.Errorf("unexpected status code %d", recipesResponse.StatusCode)
+			}
 
-        		return
-        	}
-		
-        	favorites = append(favorites, favorite)
+			return nil
+		})
+
+		checks["recipes"] = recipesCheck
+		if err != nil {
+			log.Print("Failed to reach recipes API during health-check: ", err)
+			if status == "ok" {
+				status = "degraded"
+			}
 		}
+	}
 
-		response.Header().Set("Content-Type", "application/json")
-		responseData, _ := json.Marshal(favorites)
-		response.Write(responseData)
-		return
+	if server.draining.Load() {
+		status = "draining"
 	}
-	
-	log.Printf("Handling request to add favorite for user \"%s\"", user)
-	
-	defer request.Body.Close()
-	requestBody, err := ioutil.ReadAll(request.Body)
-	if err != nil {
-		log.Print("Failed to read body for favorite addition request: ", err)
-		http.Error(response, "Failed to read submitted body", http.StatusBadRequest)
+
+	response.Header().Set("Content-Type", "application/json")
+	if status == "down" || status == "draining" {
+		response.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	writesEnabled, maintenanceEnd := server.writesEnabled(time.Now())
+	healthData := map[string]interface{}{
+		"status": status, "checks": checks, "writesEnabled": writesEnabled,
+		"inFlightRequests": server.inFlightRequests.Load()}
+
+	if !maintenanceEnd.IsZero() {
+		healthData["maintenanceUntil"] = maintenanceEnd.UTC().Format(time.RFC3339)
+	}
+
+	responseData, _ := json.Marshal(healthData)
+
+	response.Write(responseData)
+	return
+}
+
+// ---
+// Adds a sentinel favorite, reads it back and deletes it, verifying the full
+// write path of the database rather than only reads. Timing of each step is
+// reported. The sentinel is deleted even if reading it back fails.
+func (server *favoritesServer) deepHealthHandler(
+	response http.ResponseWriter, request *http.Request) {
+
+	response.Header().Add("X-Provided-By", server.hostString)
+
+	if request.Method != "GET" {
+		writeError(response, errorMethodNotAllowed, "Method not allowed")
 		return
 	}
 
-	var drink string
-	if err := json.Unmarshal(requestBody, &drink); err != nil {
-		log.Print("Failed to parse body for favorite addition request: ", err)
-		http.Error(response, "Failed to parse submitted body", http.StatusBadRequest)
+	if !server.isAdminRequest(request) {
+		log.Print("Received deep health-check request with incorrect admin key")
+		writeError(response, errorInvalidAdminKey, "Invalid admin key")
 		return
 	}
 
-	log.Printf("Adding drink \"%s\" as favorite for user \"%s\"", drink, user)
-	
-	writeResult, err := databaseConnection.WriteOneParameterized(
-		gorqlite.ParameterizedStatement{
-			Query: "INSERT INTO favorites (user, drink) VALUES (?, ?)",
-			Arguments: []interface{}{user, drink},},)
+	const sentinelUser = "__healthcheck__"
+	ctx, cancel := context.WithTimeout(request.Context(), server.config.DatabaseTimeout)
+	defer cancel()
 
-	if err != nil || writeResult.Err != nil {
-		log.Printf(
-			"Failed to persist \"%s\" as favorite for user \"%s\": \"%s\", \"%s\"",
-			drink, user, err, writeResult.Err)
+	status := "ok"
+	checks := map[string]healthCheck{
+		"write": {Status: "skipped"}, "read": {Status: "skipped"}, "delete": {Status: "skipped"}}
+
+	var id int64
+	var err error
+	checks["write"], err = runHealthCheck(func() error {
+		id, _, err = server.store.AddFavorite(ctx, sentinelUser, "Sentinel", "", time.Time{})
+		return err
+	})
+
+	if err != nil {
+		log.Print("Failed to write sentinel during deep health-check: ", err)
+		status = "down"
+
+	} else {
+		checks["read"], err = runHealthCheck(func() error {
+			found, err := server.store.HasFavorite(ctx, sentinelUser, id)
+			if err == nil && !found {
+				err = errors.New("sentinel not found after write")
+			}
+
+			return err
+		})
+
+		if err != nil {
+			log.Print("Failed to read sentinel during deep health-check: ", err)
+			status = "down"
+		}
+
+		// Uses separate context to clean up even if the request has timed out
+		cleanupCtx, cleanupCancel := context.WithTimeout(
+			context.Background(), server.config.DatabaseTimeout)
 
-		http.Error(
-			response, "Failed to write to database", http.StatusInternalServerError)
+		defer cleanupCancel()
 
-       	return
+		checks["delete"], err = runHealthCheck(func() error {
+			_, err := server.store.DeleteFavoriteByID(cleanupCtx, sentinelUser, id)
+			return err
+		})
+
+		if err != nil {
+			log.Print("Failed to delete sentinel during deep health-check: ", err)
+			status = "down"
+		}
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	if status == "down" {
+		response.WriteHeader(http.StatusServiceUnavailable)
 	}
 
+	responseData, _ := json.Marshal(map[string]interface{}{"status": status, "checks": checks})
+	response.Write(responseData)
 	return
 }
 
 // ---
-func main() {
-	http.HandleFunc("/", healthHandler)
-	http.HandleFunc("/api/favorites/", favoritesHandler)
+// Returns values, or an empty slice if values is nil, which ensures that list
+// end-points respond with an empty JSON array ("[]") rather than "null".
+func jsonList[T any](values []T) []T {
+	if values == nil {
+		return []T{}
+	}
+
+	return values
+}
+
+// ---
+// Returns pagination from "limit", "offset" and "after" query parameters,
+// defaulting to defaultLimit and the first page. Limit must be between 1 and
+// maxLimit, and offset may not exceed the configured maximum, as skipped rows
+// are still scanned. Deeper pages are instead fetched by passing the sort key
+// of the last result as "after".
+func (server *favoritesServer) parsePagination(
+	request *http.Request, defaultLimit int, maxLimit int) (pagination, error) {
+
+	query := request.URL.Query()
+	page := pagination{Limit: defaultLimit, After: query.Get("after")}
+
+	if rawCursor := query.Get("cursor"); rawCursor != "" {
+		after, err := base64.RawURLEncoding.DecodeString(rawCursor)
+		if err != nil || page.After != "" {
+			return page, fmt.Errorf("cursor must be a cursor returned by a previous request")
+		}
+
+		page.After = string(after)
+	}
+
+	if rawLimit := query.Get("limit"); rawLimit != "" {
+		parsedLimit, err := strconv.Atoi(rawLimit)
+		if err != nil || parsedLimit < 1 || parsedLimit > maxLimit {
+			return page, fmt.Errorf("limit must be between 1 and %d", maxLimit)
+		}
+
+		page.Limit = parsedLimit
+	}
+
+	if rawOffset := query.Get("offset"); rawOffset != "" {
+		parsedOffset, err := strconv.Atoi(rawOffset)
+		if err != nil || parsedOffset < 0 {
+			return page, fmt.Errorf("offset must be a non-negative integer")
+		}
+
+		if parsedOffset > server.config.MaxPaginationOffset {
+			return page, fmt.Errorf(
+				"offset must not exceed %d, use after with the last result instead",
+				server.config.MaxPaginationOffset)
+		}
+
+		if page.After != "" {
+			return page, fmt.Errorf("offset can't be combined with after or cursor")
+		}
+
+		page.Offset = parsedOffset
+	}
+
+	return page, nil
+}
+
+// ---
+// Sets opaque cursor for fetching the next page in the "X-Next-Cursor" header
+// and "Link" headers (RFC 8288) to the first, previous and next pages, keeping
+// other query parameters. The next page is only linked if the page (with last
+// result having sort key lastKey) is full. The previous page is only linked
+// for offset pagination, as cursors only page forward. Returns the linked URLs
+// by relation type and the cursor of the next page (if any), for use in
+// response bodies.
+func (server *favoritesServer) setPaginationHeaders(
+	response http.ResponseWriter, request *http.Request, page pagination, results int,
+	lastKey string) (map[string]string, string) {
+
+	if page.Limit == 0 {
+		return nil, ""
+	}
+
+	pageURL := func(parameters map[string]string) string {
+		query := request.URL.Query()
+		for _, name := range []string{"offset", "after", "cursor"} {
+			query.Del(name)
+		}
+
+		for name, value := range parameters {
+			query.Set(name, value)
+		}
+
+		return server.externalPath(request.URL.EscapedPath()) + "?" + query.Encode()
+	}
 
-	log.Print("Starting favorites web server on ", hostString)
-	log.Fatal(http.ListenAndServe(":8000", nil))
+	offsetPagination := request.URL.Query().Get("offset") != ""
+	urls := map[string]string{"first": pageURL(nil)}
+	if cursorPaginationRequested(request) {
+		urls["first"] = pageURL(map[string]string{"cursor": ""})
+	}
+
+	if offsetPagination && page.Offset > 0 {
+		previousOffset := strconv.Itoa(max(page.Offset - page.Limit, 0))
+		urls["prev"] = pageURL(map[string]string{"offset": previousOffset})
+	}
+
+	nextCursor := ""
+	if results == page.Limit {
+		cursor := base64.RawURLEncoding.EncodeToString([]byte(lastKey))
+		response.Header().Set("X-Next-Cursor", cursor)
+		nextCursor = cursor
+
+		nextParameters := map[string]string{"cursor": cursor}
+		if offsetPagination {
+			nextParameters = map[string]string{"offset": strconv.Itoa(page.Offset + page.Limit)}
+		}
+
+		urls["next"] = pageURL(nextParameters)
+	}
+
+	links := []string{}
+	for _, relation := range []string{"first", "prev", "next"} {
+		if linkURL, found := urls[relation]; found {
+			links = append(links, fmt.Sprintf(`<%s>; rel="%s"`, linkURL, relation))
+		}
+	}
+
+	response.Header().Set("Link", strings.Join(links, ", "))
+	return urls, nextCursor
+}
+
+// ---
+// Returns true if cursor pagination was requested using the "cursor" query
+// parameter, which is empty for the first page.
+func cursorPaginationRequested(request *http.Request) bool {
+	return request.URL.Query().Has("cursor")
+}
+
+// ---
+// Returns JSON list of values, or an object with the list as name and cursor
+// of the next page (if any) if cursor pagination was requested.
+func paginatedJSON[T any](
+	request *http.Request, name string, values []T, nextCursor string) []byte {
+
+	if !cursorPaginationRequested(request) {
+		responseData, _ := json.Marshal(jsonList(values))
+		return responseData
+	}
+
+	page := map[string]interface{}{name: jsonList(values)}
+	if nextCursor != "" {
+		page["nextCursor"] = nextCursor
+	}
+
+	responseData, _ := json.Marshal(page)
+	return responseData
+}
+
+// ---
+// Favorites listed by listFavorites, which may be shared between requests.
+type favoritesRead struct {
+	favorites []string
+	consistency string
+	time time.Time
+}
+
+// ---
+// Lists favorites of user matching filter, sharing a single database query
+// between concurrent identical requests to reduce load during spikes. The
+// query isn't canceled if the request triggering it is, as other requests may
+// be waiting for it, but is limited by the default database timeout instead.
+// Queries with a longer timeout requested by administrative clients aren't
+// shared, so that the requested timeout applies.
+func (server *favoritesServer) listFavorites(
+	ctx context.Context, user string, filter favoritesFilter) (favoritesRead, error) {
+
+	deadline, hasDeadline := ctx.Deadline()
+	if hasDeadline && time.Until(deadline) > server.config.DatabaseTimeout {
+		readCtx, consistency := withConsistencyRecorder(ctx)
+		read := favoritesRead{time: time.Now()}
+
+		var err error
+		read.favorites, err = server.store.ListFavorites(readCtx, user, filter)
+		read.consistency = *consistency
+		return read, err
+	}
+
+	key := fmt.Sprintf("%s\x00%+v", user, filter)
+	resultChannel := server.listGroup.DoChan(key, func() (interface{}, error) {
+		sharedCtx, cancel := context.WithTimeout(
+			context.WithoutCancel(ctx), server.config.DatabaseTimeout)
+
+		defer cancel()
+
+		readCtx, consistency := withConsistencyRecorder(sharedCtx)
+		read := favoritesRead{time: time.Now()}
+
+		var err error
+		read.favorites, err = server.store.ListFavorites(readCtx, user, filter)
+		read.consistency = *consistency
+		return read, err
+	})
+
+	select {
+	case result := <-resultChannel:
+		read, _ := result.Val.(favoritesRead)
+		return read, result.Err
+	case <-ctx.Done():
+		return favoritesRead{}, ctx.Err()
+	}
+}
+
+// ---
+// Returns filter for listing favorites from query parameters "category",
+// "from" and "to" (RFC3339, both required if either is set), "limit", "offset"
+// and "after" (a drink). Favorites aren't paginated unless one of the latter
+// is specified.
+func (server *favoritesServer) parseFavoritesFilter(
+	request *http.Request) (favoritesFilter, error) {
+
+	query := request.URL.Query()
+	filter := favoritesFilter{Category: query.Get("category")}
+
+	if query.Get("from") != "" || query.Get("to") != "" {
+		var err error
+		if filter.From, err = time.Parse(time.RFC3339, query.Get("from")); err != nil {
+			return filter, fmt.Errorf("from must be a RFC3339 timestamp")
+		}
+
+		if filter.To, err = time.Parse(time.RFC3339, query.Get("to")); err != nil {
+			return filter, fmt.Errorf("to must be a RFC3339 timestamp")
+		}
+
+		if filter.From.After(filter.To) {
+			return filter, fmt.Errorf("from must not be after to")
+		}
+	}
+
+	paginated := query.Get("limit") != "" || query.Get("offset") != "" ||
+		query.Get("after") != "" || query.Get("cursor") != ""
+
+	if paginated {
+		var err error
+		filter.pagination, err = server.parsePagination(request, 1000, 1000)
+		if err != nil {
+			return filter, err
+		}
+	}
+
+	return filter, nil
+}
+
+// ---
+type favoriteSubmission struct {
+	Drink string `json:"drink"`
+	Category string `json:"category"`
+	Timestamp string `json:"timestamp"`
+	ClientID string `json:"clientId"`
+}
+
+// ---
+// Parses body of favorite addition request, which is either a JSON string
+// containing the drink name or an object with drink and optional category.
+// Body is expected to have been validated using validateFavoriteSubmission.
+func parseFavoriteSubmission(requestBody []byte) (favoriteSubmission, error) {
+	var submission favoriteSubmission
+
+	if strings.HasPrefix(strings.TrimSpace(string(requestBody)), "\"") {
+		err := json.Unmarshal(requestBody, &submission.Drink)
+		return submission, err
+	}
+
+	err := json.Unmarshal(requestBody, &submission)
+	return submission, err
+}
+
+// ---
+// Categories may contain up to 64 letters, digits, spaces, dashes and underscores.
+func validateCategory(category string) error {
+	if len(category) > 64 {
+		return errors.New("category is longer than 64 characters")
+	}
+
+	for _, character := range category {
+		if !unicode.IsLetter(character) && !unicode.IsDigit(character) &&
+			!strings.ContainsRune(" -_", character) {
+
+			return fmt.Errorf("category contains disallowed character %q", character)
+		}
+	}
+
+	return nil
+}
+
+// ---
+func (server *favoritesServer) favoritesHandler(
+	response http.ResponseWriter, request *http.Request) {
+
+	response.Header().Add("X-Provided-By", server.hostString)
+
+	// HEAD requests are handled like GET, the server discards the response body
+	if request.Method == "HEAD" {
+		request = request.Clone(request.Context())
+		request.Method = "GET"
+	}
+	
+	if request.Method != "GET" && request.Method != "POST" && request.Method != "PATCH" {
+		writeError(response, errorMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Paths such as "/api/favorites/bob/grouped/" are otherwise treated as
+	// unknown subresources, while "/api/favorites/" is the default user's list
+	userPath := strings.TrimPrefix(request.URL.Path, "/api/favorites/")
+	if trimmedPath := strings.TrimRight(userPath, "/"); trimmedPath != userPath && trimmedPath != "" {
+		userPath = trimmedPath
+
+		if server.config.TrailingSlash == "redirect" {
+			canonicalURL := *request.URL
+			canonicalURL.Path = server.externalPath("/api/favorites/" + userPath)
+			canonicalURL.RawPath = ""
+			http.Redirect(response, request, canonicalURL.RequestURI(), http.StatusPermanentRedirect)
+			return
+		}
+	}
+
+	providedKey := request.Header.Get("X-Access-Key")
+	htmlRequested := request.Method == "GET" && request.URL.Query().Get("format") == "html"
+	if providedKey == "" && htmlRequested {
+		providedKey = request.URL.Query().Get("key")
+	}
+
+	// Administrative clients (such as import tooling) may act on behalf of any user
+	validKey, readOnlyKey := server.checkAccessKey(providedKey)
+	if !validKey && server.isAdminRequest(request) {
+		validKey = true
+	}
+
+	if !validKey {
+		log.Print("Received favorites request with incorrect access key")
+		writeError(response, errorInvalidAccessKey, "Invalid access key")
+		return
+	}
+
+	if readOnlyKey && request.Method != "GET" && request.Method != "HEAD" {
+		log.Printf("Received \"%s\" favorites request with read-only access key", request.Method)
+		writeError(response, errorReadOnlyAccessKey, "Access key is read-only")
+		return
+	}
+
+	user, subresource, _ := strings.Cut(userPath, "/")
+
+	if user == "" && server.config.DefaultUser != "" {
+		user = server.config.DefaultUser
+	}
+
+	if user == "" {
+		log.Print("Received favorites request without target user specified")
+		writeError(response, errorInvalidUsername, "URL path missing username")
+		return
+	}
+
+	ctx, cancel, err := server.databaseContext(request)
+	if err != nil {
+		log.Print("Received favorites request with invalid query timeout: ", err)
+		writeError(response, errorInvalidQueryTimeout, "Invalid query timeout")
+		return
+	}
+
+	defer cancel()
+
+	if rawID, found := strings.CutPrefix(subresource, "id/"); found {
+		server.favoriteHandler(response, request, ctx, user, rawID)
+		return
+	}
+
+	switch subresource {
+	case "":
+	case "grouped":
+		server.groupedFavoritesHandler(response, request, ctx, user)
+		return
+	case "categories":
+		server.categoriesHandler(response, request, ctx, user)
+		return
+	case "category":
+		server.updateCategoryHandler(response, request, ctx, user)
+		return
+	case "undo":
+		server.undoHandler(response, request, ctx, user)
+		return
+	case "streak":
+		server.streakHandler(response, request, ctx, user)
+		return
+	case "recommendations":
+		server.recommendationsHandler(response, request, ctx, user)
+		return
+	case "rank":
+		server.rankHandler(response, request, ctx, user)
+		return
+	case "share":
+		server.shareHandler(response, request, user)
+		return
+	default:
+		writeError(response, errorNotFound, "Unknown favorites subresource")
+		return
+	}
+
+	if request.Method == "PATCH" {
+		writeError(response, errorMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	if request.Method == "GET" {
+		log.Printf("Returning list of favorites for user \"%s\"", user)
+
+		// Representation is negotiated using the "Accept" header, which caches must respect
+		response.Header().Add("Vary", "Accept")
+
+		filter, err := server.parseFavoritesFilter(request)
+		if err != nil {
+			log.Printf(
+				"Received favorites request for user \"%s\" with invalid filter: %s", user, err)
+
+			writeError(response, errorInvalidParameter, "Invalid filter: " + err.Error())
+			return
+		}
+
+		read, err := server.listFavorites(ctx, user, filter)
+		favorites := read.favorites
+		if read.consistency != "" {
+			response.Header().Set("X-DB-Consistency", read.consistency)
+			response.Header().Set(
+				"X-Data-Freshness",
+				read.consistency + "; read-at=" + read.time.UTC().Format(time.RFC3339))
+		}
+
+		if request.Context().Err() != nil {
+			log.Printf("Client disconnected during favorites request for user \"%s\"", user)
+			return
+		}
+
+		if err != nil {
+			log.Printf("Failed query database for user \"%s\" favorites: %s", user, err)
+			writeError(response, errorDatabaseUnavailable, "Failed to query database")
+			return
+		}
+
+		lastDrink := ""
+		if len(favorites) > 0 {
+			lastDrink = favorites[len(favorites) - 1]
+		}
+
+		pageURLs, nextCursor := server.setPaginationHeaders(
+			response, request, filter.pagination, len(favorites), lastDrink)
+
+		if htmlRequested {
+			if err := writeFavoritesHTML(response, user, favorites); err != nil {
+				log.Printf("Failed to render HTML favorites for user \"%s\": %s", user, err)
+				writeError(response, errorRenderFailed, "Failed to render favorites")
+			}
+
+			return
+		}
+
+		if acceptsMediaType(request, "application/hal+json") {
+			writeFavoritesHAL(
+				response, server.externalPath(request.URL.RequestURI()), pageURLs, nextCursor,
+				favorites)
+
+			return
+		}
+
+		if acceptsMediaType(request, "application/vnd.api+json") {
+			writeFavoritesJSONAPI(
+				response, server.externalPath(request.URL.RequestURI()), pageURLs, nextCursor,
+				favorites)
+
+			return
+		}
+
+		response.Header().Set("Content-Type", "application/json")
+		response.Write(paginatedJSON(request, "favorites", favorites, nextCursor))
+		return
+	}
+	
+	log.Printf("Handling request to add favorite for user \"%s\"", user)
+	
+	defer request.Body.Close()
+	requestBody, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		log.Print("Failed to read body for favorite addition request: ", err)
+		writeBodyReadError(response, err)
+		return
+	}
+
+	problems, err := validateFavoriteSubmission(requestBody)
+	if err == nil && len(problems) > 0 {
+		log.Printf(
+			"Received invalid body for favorite addition request, found %d problem(s)",
+			len(problems))
+
+		writeErrorResponse(response, errorInvalidBody, errorResponse{
+			Error: "Invalid submitted body", Problems: problems})
+
+		return
+	}
+
+	submission, err := parseFavoriteSubmission(requestBody)
+	if err != nil {
+		log.Print("Failed to parse body for favorite addition request: ", err)
+		writeError(response, errorInvalidBody, "Failed to parse submitted body")
+		return
+	}
+
+	drink := canonicalDrink(server.config.DrinkAliases, submission.Drink)
+	if !drinkAllowed(server.config.AllowedDrinks, drink) {
+		log.Printf("Received favorite addition request with drink \"%s\" not on allow-list", drink)
+		writeError(response, errorDrinkNotAllowed, "Drink is not on the menu")
+		return
+	}
+
+	// Explicit timestamps are only accepted from administrative clients backfilling data
+	var timestamp time.Time
+	if submission.Timestamp != "" {
+		if !server.isAdminRequest(request) {
+			log.Print("Received favorite addition request with timestamp from non-admin client")
+			writeError(
+				response, errorTimestampNotAllowed,
+				"Timestamp may only be specified by administrators")
+
+			return
+		}
+
+		timestamp, err = time.Parse(time.RFC3339, submission.Timestamp)
+		if err != nil || timestamp.After(time.Now().Add(server.config.BackfillMaxSkew)) {
+			log.Printf(
+				"Received favorite addition request with invalid timestamp \"%s\"",
+				submission.Timestamp)
+
+			writeError(
+				response, errorInvalidTimestamp,
+				"Timestamp must be in RFC 3339 format and not in the future")
+
+			return
+		}
+	}
+
+	if request.Context().Err() != nil {
+		log.Printf("Client disconnected before favorite was added for user \"%s\"", user)
+		return
+	}
+
+	if submission.ClientID != "" {
+		server.logFavoriteAddition(request, user, drink)
+		server.upsertFavorite(response, request, ctx, user, drink, submission, timestamp)
+		return
+	}
+
+	// Backfills of the same drink at different times are distinct favorites,
+	// so only additions at the current time are deduplicated
+	if server.deduplicator != nil && timestamp.IsZero() &&
+		!server.deduplicator.Claim(server.userKey(user), drink) {
+
+		log.Printf(
+			"Ignoring duplicate request to add drink \"%s\" as favorite for user \"%s\"",
+			drink, user)
+
+		writeExistingFavorite(response, request, drink)
+		return
+	}
+
+	server.logFavoriteAddition(request, user, drink)
+
+	if server.config.QueuedWrites {
+		server.queueFavorite(response, ctx, user, drink, submission.Category, timestamp)
+		return
+	}
+
+	id, created, err := server.store.AddFavorite(
+		ctx, user, drink, submission.Category, timestamp)
+
+	if err != nil {
+		log.Printf(
+			"Failed to persist \"%s\" as favorite for user \"%s\": %s", drink, user, err)
+
+		if server.deduplicator != nil && timestamp.IsZero() {
+			server.deduplicator.Release(server.userKey(user), drink)
+		}
+
+		writeError(response, errorDatabaseUnavailable, "Failed to write to database")
+		return
+	}
+
+	if !created {
+		log.Printf("Drink \"%s\" is already a favorite of user \"%s\"", drink, user)
+		writeExistingFavorite(response, request, drink)
+		return
+	}
+
+	favoritesAddedCounter.WithLabelValues(server.drinkLabeler.Label(drink)).Inc()
+	server.undoHistory.Record(server.userKey(user), undoAction{kind: "add", id: id, drink: drink})
+
+	response.Header().Set(
+		"Location", server.externalPath(fmt.Sprintf(
+			"/api/favorites/%s/id/%d", url.PathEscape(user), id)))
+
+	if preferMinimalReturn(request) {
+		response.Header().Set("Preference-Applied", "return=minimal")
+		response.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	response.Header().Set("Preference-Applied", "return=representation")
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(http.StatusCreated)
+	responseData, _ := json.Marshal(createdFavorite{
+		ID: server.jsonID(id), Drink: drink, Category: submission.Category})
+
+	response.Write(responseData)
+	return
+}
+
+// ---
+// Adds or updates favorite identified by client-generated identifier and
+// responds with the stored favorite, allowing offline-first clients to safely
+// re-submit favorites. Identifiers already used for another drink (or by
+// another user) are rejected with status 409. Responds with status 201 if the
+// favorite was created and 200 if it already existed, omitting the favorite
+// if the client prefers a minimal return. Additions can't be undone, and
+// writes are never queued, as the stored favorite is returned.
+func (server *favoritesServer) upsertFavorite(
+	response http.ResponseWriter, request *http.Request, ctx context.Context, user string,
+	drink string, submission favoriteSubmission, timestamp time.Time) {
+
+	clientID := strings.ToLower(submission.ClientID)
+	log.Printf(
+		"Storing drink \"%s\" as favorite with client identifier \"%s\" for user \"%s\"",
+		drink, clientID, user)
+
+	favorite, created, stored, err := server.store.UpsertFavorite(
+		ctx, user, clientID, drink, submission.Category, timestamp)
+
+	if err != nil {
+		log.Printf(
+			"Failed to persist \"%s\" as favorite for user \"%s\": %s", drink, user, err)
+
+		writeError(response, errorDatabaseUnavailable, "Failed to write to database")
+		return
+	}
+
+	if !stored {
+		log.Printf(
+			"Client identifier \"%s\" submitted by user \"%s\" is used by another " +
+			"user or for another drink", clientID, user)
+
+		writeError(response, errorClientIDConflict, "Client identifier is already in use")
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		favoritesAddedCounter.WithLabelValues(server.drinkLabeler.Label(drink)).Inc()
+		status = http.StatusCreated
+	}
+
+	response.Header().Set(
+		"Location", server.externalPath(fmt.Sprintf(
+			"/api/favorites/%s/id/%d", url.PathEscape(user), favorite.ID)))
+
+	if preferMinimalReturn(request) {
+		response.Header().Set("Preference-Applied", "return=minimal")
+		response.WriteHeader(status)
+		return
+	}
+
+	response.Header().Set("Preference-Applied", "return=representation")
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(status)
+
+	// Identifier of the outer struct takes precedence over the embedded one
+	responseData, _ := json.Marshal(struct {
+		ID interface{} `json:"id"`
+		storedFavorite
+	}{server.jsonID(favorite.ID), favorite})
+
+	response.Write(responseData)
+	return
+}
+
+// ---
+// Queues addition of favorite and responds with status 202, as the favorite
+// hasn't been stored yet. Queued favorites lack identifiers, so they can't be
+// returned or undone.
+func (server *favoritesServer) queueFavorite(
+	response http.ResponseWriter, ctx context.Context, user string, drink string,
+	category string, timestamp time.Time) {
+
+	err := server.store.QueueFavorite(ctx, user, drink, category, timestamp)
+	if err != nil {
+		log.Printf(
+			"Failed to queue \"%s\" as favorite for user \"%s\": %s", drink, user, err)
+
+		if server.deduplicator != nil && timestamp.IsZero() {
+			server.deduplicator.Release(server.userKey(user), drink)
+		}
+
+		writeError(response, errorDatabaseUnavailable, "Failed to write to database")
+		return
+	}
+
+	favoritesAddedCounter.WithLabelValues(server.drinkLabeler.Label(drink)).Inc()
+	response.Header().Set(
+		"Location", server.externalPath("/api/favorites/" + url.PathEscape(user)))
+	response.WriteHeader(http.StatusAccepted)
+	return
+}
+
+// ---
+// Returns key for user in in-memory state (such as undo history), which is
+// normalized like usernames are by the database if they are case-insensitive.
+// Like LOWER in SQLite, only ASCII letters are folded.
+func (server *favoritesServer) userKey(user string) string {
+	if !server.config.CaseInsensitiveUsers {
+		return user
+	}
+
+	return strings.Map(func(character rune) rune {
+		if character >= 'A' && character <= 'Z' {
+			return character + ('a' - 'A')
+		}
+
+		return character
+	}, user)
+}
+
+// ---
+// Returns identifier as number, or as string if configured, for use in JSON
+// responses.
+func (server *favoritesServer) jsonID(id int64) interface{} {
+	if server.config.IDsAsStrings {
+		return strconv.FormatInt(id, 10)
+	}
+
+	return id
+}
+
+// ---
+type createdFavorite struct {
+	ID interface{} `json:"id"`
+	Drink string `json:"drink"`
+	Category string `json:"category"`
+}
+
+// ---
+// Response to additions of drinks which are already favorites of the user.
+type existingFavorite struct {
+	Drink string `json:"drink"`
+	AlreadyFavorited bool `json:"alreadyFavorited"`
+}
+
+// ---
+// Responds to addition of drink already favorited by user with status 200. As
+// the existing favorite isn't looked up, its location isn't included.
+func writeExistingFavorite(response http.ResponseWriter, request *http.Request, drink string) {
+	if preferMinimalReturn(request) {
+		response.Header().Set("Preference-Applied", "return=minimal")
+		response.WriteHeader(http.StatusOK)
+		return
+	}
+
+	response.Header().Set("Preference-Applied", "return=representation")
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(http.StatusOK)
+	responseData, _ := json.Marshal(existingFavorite{Drink: drink, AlreadyFavorited: true})
+	response.Write(responseData)
+}
+
+// ---
+// Returns true if client prefers responses without body using the "Prefer"
+// header (RFC 7240), such as "Prefer: return=minimal".
+func preferMinimalReturn(request *http.Request) bool {
+	for _, header := range request.Header.Values("Prefer") {
+		for _, preference := range strings.Split(header, ",") {
+			preference, _, _ = strings.Cut(preference, ";")
+			if strings.EqualFold(strings.TrimSpace(preference), "return=minimal") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// ---
+// Returns favorites of user bucketed by uppercase first letter, with drinks
+// starting with non-alphabetic characters placed in the "#" bucket.
+func (server *favoritesServer) groupedFavoritesHandler(
+	response http.ResponseWriter, request *http.Request, ctx context.Context, user string) {
+
+	if request.Method != "GET" {
+		writeError(response, errorMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	log.Printf("Returning grouped list of favorites for user \"%s\"", user)
+
+	favorites, err := server.store.ListFavorites(ctx, user, favoritesFilter{})
+	if request.Context().Err() != nil {
+		log.Printf("Client disconnected during favorites request for user \"%s\"", user)
+		return
+	}
+
+	if err != nil {
+		log.Printf("Failed query database for user \"%s\" favorites: %s", user, err)
+		writeError(response, errorDatabaseUnavailable, "Failed to query database")
+		return
+	}
+
+	groupedFavorites := map[string][]string{}
+	for _, favorite := range favorites {
+		bucket := "#"
+		for _, firstCharacter := range favorite {
+			if unicode.IsLetter(firstCharacter) {
+				bucket = string(unicode.ToUpper(firstCharacter))
+			}
+
+			break
+		}
+
+		groupedFavorites[bucket] = append(groupedFavorites[bucket], favorite)
+	}
+
+	for _, bucketFavorites := range groupedFavorites {
+		sort.Strings(bucketFavorites)
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	responseData, _ := json.Marshal(groupedFavorites)
+	response.Write(responseData)
+	return
+}
+
+// ---
+// Returns single favorite of user by identifier, including its category and
+// when it was added.
+func (server *favoritesServer) favoriteHandler(
+	response http.ResponseWriter, request *http.Request, ctx context.Context, user string,
+	rawID string) {
+
+	if request.Method != "GET" {
+		writeError(response, errorMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	id, err := strconv.ParseInt(rawID, 10, 64)
+	if err != nil || id < 1 {
+		log.Printf("Received favorite request with invalid identifier \"%s\"", rawID)
+		writeError(
+			response, errorInvalidParameter, "Favorite identifier must be a positive integer")
+
+		return
+	}
+
+	log.Printf("Returning favorite %d of user \"%s\"", id, user)
+
+	favorite, found, err := server.store.GetFavorite(ctx, user, id)
+	if request.Context().Err() != nil {
+		log.Printf("Client disconnected during favorite request for user \"%s\"", user)
+		return
+	}
+
+	if err != nil {
+		log.Printf("Failed query database for favorite %d of user \"%s\": %s", id, user, err)
+		writeError(response, errorDatabaseUnavailable, "Failed to query database")
+		return
+	}
+
+	if !found {
+		writeError(response, errorNotFavorite, "Favorite not found")
+		return
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+
+	// Identifier of the outer struct takes precedence over the embedded one
+	responseData, _ := json.Marshal(struct {
+		ID interface{} `json:"id"`
+		storedFavorite
+	}{server.jsonID(favorite.ID), favorite})
+
+	response.Write(responseData)
+	return
+}
+
+// ---
+// Returns distinct categories used for favorites of user.
+func (server *favoritesServer) categoriesHandler(
+	response http.ResponseWriter, request *http.Request, ctx context.Context, user string) {
+
+	if request.Method != "GET" {
+		writeError(response, errorMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	log.Printf("Returning list of favorite categories for user \"%s\"", user)
+
+	categories, err := server.store.ListCategories(ctx, user)
+	if request.Context().Err() != nil {
+		log.Printf("Client disconnected during categories request for user \"%s\"", user)
+		return
+	}
+
+	if err != nil {
+		log.Printf("Failed query database for user \"%s\" categories: %s", user, err)
+		writeError(response, errorDatabaseUnavailable, "Failed to query database")
+		return
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	responseData, _ := json.Marshal(jsonList(categories))
+	response.Write(responseData)
+	return
+}
+
+// ---
+// Returns drinks recommended for user based on favorites of other users. Users
+// sharing at least one favorite with user are considered similar, and drinks
+// favorited by them are ranked by the number of similar users favoriting each
+// drink. Drinks already favorited by user are excluded, as are ties beyond the
+// "limit" query parameter (default 5, at most 50), which are broken by name.
+func (server *favoritesServer) recommendationsHandler(
+	response http.ResponseWriter, request *http.Request, ctx context.Context, user string) {
+
+	if request.Method != "GET" {
+		writeError(response, errorMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	limit := 5
+	if rawLimit := request.URL.Query().Get("limit"); rawLimit != "" {
+		parsedLimit, err := strconv.Atoi(rawLimit)
+		if err != nil || parsedLimit < 1 || parsedLimit > 50 {
+			log.Printf("Received recommendations request with invalid limit \"%s\"", rawLimit)
+			writeError(
+				response, errorInvalidParameter,
+				"Query parameter limit must be between 1 and 50")
+
+			return
+		}
+
+		limit = parsedLimit
+	}
+
+	log.Printf("Returning drink recommendations for user \"%s\"", user)
+
+	drinks, err := server.store.Recommendations(ctx, user, limit)
+	if request.Context().Err() != nil {
+		log.Printf("Client disconnected during recommendations request for user \"%s\"", user)
+		return
+	}
+
+	if err != nil {
+		log.Printf("Failed query database for user \"%s\" recommendations: %s", user, err)
+		writeError(response, errorDatabaseUnavailable, "Failed to query database")
+		return
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	responseData, _ := json.Marshal(jsonList(drinks))
+	response.Write(responseData)
+	return
+}
+
+// ---
+// Returns position of user among users who favorited drink specified by the
+// "drink" query parameter, ordered by when each user first favorited it.
+func (server *favoritesServer) rankHandler(
+	response http.ResponseWriter, request *http.Request, ctx context.Context, user string) {
+
+	if request.Method != "GET" {
+		writeError(response, errorMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	drink := request.URL.Query().Get("drink")
+	if drink == "" {
+		log.Print("Received drink rank request without drink")
+		writeError(response, errorInvalidParameter, "Query parameter drink is missing")
+		return
+	}
+
+	drink = canonicalDrink(server.config.DrinkAliases, drink)
+	log.Printf("Returning rank of user \"%s\" for drink \"%s\"", user, drink)
+
+	rank, total, err := server.store.DrinkRank(ctx, user, drink)
+	if request.Context().Err() != nil {
+		log.Printf("Client disconnected during drink rank request for user \"%s\"", user)
+		return
+	}
+
+	if err != nil {
+		log.Printf("Failed query database for user \"%s\" drink rank: %s", user, err)
+		writeError(response, errorDatabaseUnavailable, "Failed to query database")
+		return
+	}
+
+	if rank == 0 {
+		writeError(response, errorNotFavorite, "Drink is not a favorite of user")
+		return
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	responseData, _ := json.Marshal(map[string]int64{"rank": rank, "total": total})
+	response.Write(responseData)
+	return
+}
+
+// ---
+// Returns length of current and longest runs of consecutive days (in UTC) on
+// which user added favorites. The current streak is kept alive until the end
+// of the day after the last favorite, giving users the whole day to extend it.
+func (server *favoritesServer) streakHandler(
+	response http.ResponseWriter, request *http.Request, ctx context.Context, user string) {
+
+	if request.Method != "GET" {
+		writeError(response, errorMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	log.Printf("Returning favorite streak for user \"%s\"", user)
+
+	dates, err := server.store.FavoriteDates(ctx, user)
+	if request.Context().Err() != nil {
+		log.Printf("Client disconnected during streak request for user \"%s\"", user)
+		return
+	}
+
+	if err != nil {
+		log.Printf("Failed query database for user \"%s\" favorite dates: %s", user, err)
+		writeError(response, errorDatabaseUnavailable, "Failed to query database")
+		return
+	}
+
+	current, longest := favoriteStreaks(dates, time.Now().UTC())
+
+	response.Header().Set("Content-Type", "application/json")
+	responseData, _ := json.Marshal(struct {
+		Current int `json:"current"`
+		Longest int `json:"longest"`
+	}{current, longest})
+
+	response.Write(responseData)
+	return
+}
+
+// ---
+// Returns current and longest streak of consecutive days in dates, which must
+// be distinct dates at midnight UTC in ascending order.
+func favoriteStreaks(dates []time.Time, now time.Time) (int, int) {
+	current, longest := 0, 0
+	for index, date := range dates {
+		if index > 0 && dates[index - 1].AddDate(0, 0, 1).Equal(date) {
+			current++
+		} else {
+			current = 1
+		}
+
+		longest = max(longest, current)
+	}
+
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	if len(dates) == 0 || dates[len(dates) - 1].Before(today.AddDate(0, 0, -1)) {
+		current = 0
+	}
+
+	return current, longest
+}
+
+// ---
+// Moves favorite drink of user to another category, or out of any category if
+// the submitted category is empty.
+func (server *favoritesServer) updateCategoryHandler(
+	response http.ResponseWriter, request *http.Request, ctx context.Context, user string) {
+
+	if request.Method != "PATCH" {
+		writeError(response, errorMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	defer request.Body.Close()
+	requestBody, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		log.Print("Failed to read body for category update request: ", err)
+		writeBodyReadError(response, err)
+		return
+	}
+
+	var submission favoriteSubmission
+	if err := json.Unmarshal(requestBody, &submission); err != nil || submission.Drink == "" {
+		log.Print("Failed to parse body for category update request: ", err)
+		writeError(response, errorInvalidBody, "Failed to parse submitted body")
+		return
+	}
+
+	if err := validateCategory(submission.Category); err != nil {
+		log.Print("Received category update request with invalid category: ", err)
+		writeError(response, errorInvalidCategory, "Invalid category")
+		return
+	}
+
+	submission.Drink = canonicalDrink(server.config.DrinkAliases, submission.Drink)
+
+	log.Printf(
+		"Moving favorite drink \"%s\" of user \"%s\" to category \"%s\"",
+		submission.Drink, user, submission.Category)
+
+	found, err := server.store.UpdateCategory(ctx, user, submission.Drink, submission.Category)
+	if err != nil {
+		log.Printf("Failed to update category for user \"%s\": %s", user, err)
+		writeError(response, errorDatabaseUnavailable, "Failed to write to database")
+		return
+	}
+
+	if !found {
+		log.Printf(
+			"Drink \"%s\" is not a favorite of user \"%s\", can't update category",
+			submission.Drink, user)
+
+		writeError(response, errorNotFavorite, "Drink is not a favorite")
+		return
+	}
+
+	return
+}
+
+// ---
+// Reverts the last action recorded for user. History is kept in-memory per
+// server instance on a best-effort basis and only covers favorite additions,
+// as there is currently no way of deleting favorites through the API.
+func (server *favoritesServer) undoHandler(
+	response http.ResponseWriter, request *http.Request, ctx context.Context, user string) {
+
+	if request.Method != "POST" {
+		writeError(response, errorMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	action, exists := server.undoHistory.Pop(server.userKey(user))
+	if !exists {
+		log.Printf("Received undo request for user \"%s\" without recorded actions", user)
+		writeError(response, errorNothingToUndo, "Nothing to undo")
+		return
+	}
+
+	log.Printf(
+		"Undoing addition of drink \"%s\" as favorite for user \"%s\"", action.drink, user)
+
+	found, err := server.store.DeleteFavoriteByID(ctx, user, action.id)
+	if err != nil {
+		log.Printf("Failed to undo action for user \"%s\": %s", user, err)
+		server.undoHistory.Record(server.userKey(user), action)
+		writeError(response, errorDatabaseUnavailable, "Failed to write to database")
+		return
+	}
+
+	if !found {
+		log.Printf("Favorite to undo for user \"%s\" no longer exists", user)
+		writeError(response, errorUndoConflict, "Favorite has changed since action")
+		return
+	}
+
+	return
+}
+
+// ---
+// Returns time-limited token and URL for viewing favorites of user without
+// access key.
+func (server *favoritesServer) shareHandler(
+	response http.ResponseWriter, request *http.Request, user string) {
+
+	if request.Method != "GET" {
+		writeError(response, errorMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	if server.config.ShareSecret == "" {
+		writeError(response, errorSharingDisabled, "Sharing of favorites is disabled")
+		return
+	}
+
+	log.Printf("Creating share token for favorites of user \"%s\"", user)
+
+	expires := time.Now().Add(server.config.ShareTTL)
+	token := signShareToken([]byte(server.config.ShareSecret), user, expires)
+
+	response.Header().Set("Content-Type", "application/json")
+	responseData, _ := json.Marshal(map[string]string{
+		"token": token, "url": server.externalPath("/s/" + token),
+		"expires": expires.UTC().Format(time.RFC3339)})
+
+	response.Write(responseData)
+	return
+}
+
+// ---
+// Returns favorites of user in HTML format if share token in the URL path is
+// valid, which grants read-only access without access key until it expires.
+func (server *favoritesServer) sharedFavoritesHandler(
+	response http.ResponseWriter, request *http.Request) {
+
+	response.Header().Add("X-Provided-By", server.hostString)
+
+	if request.Method != "GET" {
+		writeError(response, errorMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	if server.config.ShareSecret == "" {
+		writeError(response, errorSharingDisabled, "Sharing of favorites is disabled")
+		return
+	}
+
+	user, err := verifyShareToken(
+		[]byte(server.config.ShareSecret), strings.TrimPrefix(request.URL.Path, "/s/"),
+		time.Now())
+
+	if err != nil {
+		log.Print("Received shared favorites request with invalid token: ", err)
+		writeError(response, errorInvalidShareToken, "Invalid or expired share token")
+		return
+	}
+
+	ctx, cancel, err := server.databaseContext(request)
+	if err != nil {
+		log.Print("Received shared favorites request with invalid query timeout: ", err)
+		writeError(response, errorInvalidQueryTimeout, "Invalid query timeout")
+		return
+	}
+
+	defer cancel()
+
+	log.Printf("Returning shared favorites of user \"%s\"", user)
+
+	favorites, err := server.store.ListFavorites(ctx, user, favoritesFilter{})
+	if request.Context().Err() != nil {
+		log.Printf("Client disconnected during shared favorites request for user \"%s\"", user)
+		return
+	}
+
+	if err != nil {
+		log.Printf("Failed query database for user \"%s\" shared favorites: %s", user, err)
+		writeError(response, errorDatabaseUnavailable, "Failed to query database")
+		return
+	}
+
+	if err := writeFavoritesHTML(response, user, favorites); err != nil {
+		log.Printf("Failed to render HTML shared favorites for user \"%s\": %s", user, err)
+		writeError(response, errorRenderFailed, "Failed to render favorites")
+	}
+
+	return
+}
+
+// ---
+// Returns drinks favorited by all users listed in the "users" query parameter.
+func (server *favoritesServer) commonFavoritesHandler(
+	response http.ResponseWriter, request *http.Request) {
+
+	response.Header().Add("X-Provided-By", server.hostString)
+
+	if request.Method != "GET" {
+		writeError(response, errorMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	if validKey, _ := server.checkAccessKey(request.Header.Get("X-Access-Key")); !validKey {
+		log.Print("Received common favorites request with incorrect access key")
+		writeError(response, errorInvalidAccessKey, "Invalid access key")
+		return
+	}
+
+	users := []string{}
+	seenUsers := map[string]bool{}
+	for _, user := range strings.Split(request.URL.Query().Get("users"), ",") {
+		user = strings.TrimSpace(user)
+		if user == "" || seenUsers[server.userKey(user)] {
+			continue
+		}
+
+		seenUsers[server.userKey(user)] = true
+		users = append(users, user)
+	}
+
+	if len(users) < 2 || len(users) > 10 {
+		log.Printf("Received common favorites request for %d users", len(users))
+		writeError(
+			response, errorInvalidUsername,
+			"Query parameter users must list 2 to 10 usernames")
+
+		return
+	}
+
+	ctx, cancel, err := server.databaseContext(request)
+	if err != nil {
+		log.Print("Received common favorites request with invalid query timeout: ", err)
+		writeError(response, errorInvalidQueryTimeout, "Invalid query timeout")
+		return
+	}
+
+	defer cancel()
+
+	log.Printf("Returning common favorites for users \"%s\"", strings.Join(users, ", "))
+
+	favorites, err := server.store.CommonFavorites(ctx, users)
+	if request.Context().Err() != nil {
+		log.Print("Client disconnected during common favorites request")
+		return
+	}
+
+	if err != nil {
+		log.Print("Failed to query database for common favorites: ", err)
+		writeError(response, errorDatabaseUnavailable, "Failed to query database")
+		return
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	responseData, _ := json.Marshal(jsonList(favorites))
+	response.Write(responseData)
+	return
+}
+
+// ---
+// Returns drinks favorited only by the "base" user, only by the "other" user
+// and by both. The combined number of drinks returned is capped, in which case
+// "truncated" is set.
+func (server *favoritesServer) diffFavoritesHandler(
+	response http.ResponseWriter, request *http.Request) {
+
+	response.Header().Add("X-Provided-By", server.hostString)
+
+	if request.Method != "GET" {
+		writeError(response, errorMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	if validKey, _ := server.checkAccessKey(request.Header.Get("X-Access-Key")); !validKey {
+		log.Print("Received favorites diff request with incorrect access key")
+		writeError(response, errorInvalidAccessKey, "Invalid access key")
+		return
+	}
+
+	baseUser := strings.TrimSpace(request.URL.Query().Get("base"))
+	otherUser := strings.TrimSpace(request.URL.Query().Get("other"))
+
+	if baseUser == "" || otherUser == "" {
+		log.Print("Received favorites diff request without base or other user")
+		writeError(
+			response, errorInvalidUsername,
+			"Query parameters base and other must specify usernames")
+
+		return
+	}
+
+	ctx, cancel, err := server.databaseContext(request)
+	if err != nil {
+		log.Print("Received favorites diff request with invalid query timeout: ", err)
+		writeError(response, errorInvalidQueryTimeout, "Invalid query timeout")
+		return
+	}
+
+	defer cancel()
+
+	log.Printf("Returning favorites diff of users \"%s\" and \"%s\"", baseUser, otherUser)
+
+	baseFavorites, err := server.store.ListFavorites(ctx, baseUser, favoritesFilter{})
+	var otherFavorites []string
+	if err == nil {
+		otherFavorites, err = server.store.ListFavorites(ctx, otherUser, favoritesFilter{})
+	}
+
+	if request.Context().Err() != nil {
+		log.Print("Client disconnected during favorites diff request")
+		return
+	}
+
+	if err != nil {
+		log.Print("Failed to query database for favorites diff: ", err)
+		writeError(response, errorDatabaseUnavailable, "Failed to query database")
+		return
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	responseData, _ := json.Marshal(diffFavorites(baseFavorites, otherFavorites, 1000))
+	response.Write(responseData)
+	return
+}
+
+// ---
+type favoritesDiff struct {
+	OnlyBase []string `json:"onlyBase"`
+	OnlyOther []string `json:"onlyOther"`
+	Common []string `json:"common"`
+	Truncated bool `json:"truncated"`
+}
+
+// ---
+// Returns set differences and intersection of favorites, containing at most
+// maxDrinks drinks in total.
+func diffFavorites(
+	baseFavorites []string, otherFavorites []string, maxDrinks int) favoritesDiff {
+
+	diff := favoritesDiff{OnlyBase: []string{}, OnlyOther: []string{}, Common: []string{}}
+
+	otherSet := map[string]bool{}
+	for _, drink := range otherFavorites {
+		otherSet[drink] = true
+	}
+
+	baseSet := map[string]bool{}
+	count := 0
+	add := func(list *[]string, drink string) {
+		if count >= maxDrinks {
+			diff.Truncated = true
+			return
+		}
+
+		*list = append(*list, drink)
+		count++
+	}
+
+	for _, drink := range baseFavorites {
+		baseSet[drink] = true
+		if otherSet[drink] {
+			add(&diff.Common, drink)
+
+		} else {
+			add(&diff.OnlyBase, drink)
+		}
+	}
+
+	for _, drink := range otherFavorites {
+		if !baseSet[drink] {
+			add(&diff.OnlyOther, drink)
+		}
+	}
+
+	return diff
+}
+
+// ---
+// Returns number of favorites matching the optional "user", "drink" and
+// "since" (RFC3339) query parameters. Counting favorites of a single user
+// requires the access key, while counting favorites of all users (without the
+// "user" parameter) requires the admin key.
+func (server *favoritesServer) countHandler(
+	response http.ResponseWriter, request *http.Request) {
+
+	response.Header().Add("X-Provided-By", server.hostString)
+
+	if request.Method != "GET" {
+		writeError(response, errorMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	user := request.URL.Query().Get("user")
+	if user == "" && !server.isAdminRequest(request) {
+		log.Print("Received global count request with incorrect admin key")
+		writeError(response, errorInvalidAdminKey, "Invalid admin key")
+		return
+	}
+
+	if validKey, _ := server.checkAccessKey(request.Header.Get("X-Access-Key")); user != "" &&
+		!validKey && !server.isAdminRequest(request) {
+
+		log.Print("Received count request with incorrect access key")
+		writeError(response, errorInvalidAccessKey, "Invalid access key")
+		return
+	}
+
+	filter := countFilter{}
+	if drink := request.URL.Query().Get("drink"); drink != "" {
+		filter.Drink = canonicalDrink(server.config.DrinkAliases, drink)
+	}
+
+	if sinceParameter := request.URL.Query().Get("since"); sinceParameter != "" {
+		parsedSince, err := time.Parse(time.RFC3339, sinceParameter)
+		if err != nil {
+			log.Print("Received count request with invalid since parameter: ", err)
+			writeError(response, errorInvalidParameter, "Invalid since parameter")
+			return
+		}
+
+		filter.Since = parsedSince
+	}
+
+	ctx, cancel, err := server.databaseContext(request)
+	if err != nil {
+		log.Print("Received count request with invalid query timeout: ", err)
+		writeError(response, errorInvalidQueryTimeout, "Invalid query timeout")
+		return
+	}
+
+	defer cancel()
+
+	log.Printf("Returning count of favorites for user \"%s\" and drink \"%s\"", user, filter.Drink)
+
+	count, err := server.store.CountFavorites(ctx, user, filter)
+	if err != nil {
+		log.Print("Failed to query database for count of favorites: ", err)
+		writeError(response, errorDatabaseUnavailable, "Failed to query database")
+		return
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	responseData, _ := json.Marshal(map[string]int64{"count": count})
+	response.Write(responseData)
+	return
+}
+
+// ---
+// Returns whether the provided access key is valid and if it's read-only,
+// enabling clients to verify their configuration.
+func (server *favoritesServer) authCheckHandler(
+	response http.ResponseWriter, request *http.Request) {
+
+	response.Header().Add("X-Provided-By", server.hostString)
+
+	if request.Method != "GET" {
+		writeError(response, errorMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	validKey, readOnlyKey := server.checkAccessKey(request.Header.Get("X-Access-Key"))
+	if !validKey {
+		log.Print("Received access key check request with incorrect access key")
+		writeError(response, errorInvalidAccessKey, "Invalid access key")
+		return
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	responseData, _ := json.Marshal(map[string]bool{"valid": true, "readOnly": readOnlyKey})
+	response.Write(responseData)
+	return
+}
+
+// ---
+// Returns drinks starting with the "prefix" query parameter for autocompletion,
+// most favorited first.
+func (server *favoritesServer) drinksHandler(
+	response http.ResponseWriter, request *http.Request) {
+
+	response.Header().Add("X-Provided-By", server.hostString)
+
+	if request.Method != "GET" {
+		writeError(response, errorMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	if validKey, _ := server.checkAccessKey(request.Header.Get("X-Access-Key")); !validKey {
+		log.Print("Received drink suggestions request with incorrect access key")
+		writeError(response, errorInvalidAccessKey, "Invalid access key")
+		return
+	}
+
+	prefix := request.URL.Query().Get("prefix")
+	limit := 10
+
+	if rawLimit := request.URL.Query().Get("limit"); rawLimit != "" {
+		parsedLimit, err := strconv.Atoi(rawLimit)
+		if err != nil || parsedLimit < 1 {
+			log.Printf("Received drink suggestions request with invalid limit \"%s\"", rawLimit)
+			writeError(
+				response, errorInvalidParameter,
+				"Query parameter limit must be a positive integer")
+
+			return
+		}
+
+		limit = parsedLimit
+	}
+
+	// Short prefixes match most drinks, which shouldn't all be returned
+	limit = min(limit, server.config.AutocompleteMax)
+
+	ctx, cancel, err := server.databaseContext(request)
+	if err != nil {
+		log.Print("Received drink suggestions request with invalid query timeout: ", err)
+		writeError(response, errorInvalidQueryTimeout, "Invalid query timeout")
+		return
+	}
+
+	defer cancel()
+
+	log.Printf("Returning drink suggestions for prefix \"%s\"", prefix)
+
+	drinks, err := server.store.SuggestDrinks(ctx, prefix, limit)
+	if request.Context().Err() != nil {
+		log.Print("Client disconnected during drink suggestions request")
+		return
+	}
+
+	if err != nil {
+		log.Print("Failed to query database for drink suggestions: ", err)
+		writeError(response, errorDatabaseUnavailable, "Failed to query database")
+		return
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	responseData, _ := json.Marshal(jsonList(drinks))
+	response.Write(responseData)
+	return
+}
+
+// ---
+// Returns columns present in the favorites table, useful for verifying that
+// schema migrations have been applied.
+func (server *favoritesServer) schemaHandler(response http.ResponseWriter, request *http.Request) {
+	response.Header().Add("X-Provided-By", server.hostString)
+
+	if request.Method != "GET" {
+		writeError(response, errorMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	if !server.isAdminRequest(request) {
+		log.Print("Received schema request with incorrect admin key")
+		writeError(response, errorInvalidAdminKey, "Invalid admin key")
+		return
+	}
+
+	ctx, cancel, err := server.databaseContext(request)
+	if err != nil {
+		log.Print("Received schema request with invalid query timeout: ", err)
+		writeError(response, errorInvalidQueryTimeout, "Invalid query timeout")
+		return
+	}
+
+	defer cancel()
+
+	log.Print("Returning schema of favorites table")
+
+	columns, err := server.store.Schema(ctx)
+	if err != nil {
+		log.Print("Failed to query database for schema: ", err)
+		writeError(response, errorDatabaseUnavailable, "Failed to query database")
+		return
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	responseData, _ := json.Marshal(jsonList(columns))
+	response.Write(responseData)
+	return
+}
+
+// ---
+// Returns users who added favorites after the time specified by the "since"
+// query parameter (RFC3339), defaulting to the last seven days.
+func (server *favoritesServer) activeUsersHandler(
+	response http.ResponseWriter, request *http.Request) {
+
+	response.Header().Add("X-Provided-By", server.hostString)
+
+	if request.Method != "GET" {
+		writeError(response, errorMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	if !server.isAdminRequest(request) {
+		log.Print("Received active users request with incorrect admin key")
+		writeError(response, errorInvalidAdminKey, "Invalid admin key")
+		return
+	}
+
+	since := time.Now().Add(-7 * 24 * time.Hour)
+	if sinceParameter := request.URL.Query().Get("since"); sinceParameter != "" {
+		parsedSince, err := time.Parse(time.RFC3339, sinceParameter)
+		if err != nil {
+			log.Print("Received active users request with invalid since parameter: ", err)
+			writeError(response, errorInvalidParameter, "Invalid since parameter")
+			return
+		}
+
+		since = parsedSince
+	}
+
+	ctx, cancel, err := server.databaseContext(request)
+	if err != nil {
+		log.Print("Received active users request with invalid query timeout: ", err)
+		writeError(response, errorInvalidQueryTimeout, "Invalid query timeout")
+		return
+	}
+
+	defer cancel()
+
+	log.Print("Returning users active since ", since.Format(time.RFC3339))
+
+	users, err := server.store.ActiveUsers(ctx, since)
+	if err != nil {
+		log.Print("Failed to query database for active users: ", err)
+		writeError(response, errorDatabaseUnavailable, "Failed to query database")
+		return
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	responseData, _ := json.Marshal(jsonList(users))
+	response.Write(responseData)
+	return
+}
+
+// ---
+// Returns when each user first and last added a favorite and number of
+// favorites added, for analysis of churn. Paginated using "limit" (default
+// 100, at most 1000) and either "offset", "after" (a user) or "cursor" query
+// parameters.
+func (server *favoritesServer) userActivityHandler(
+	response http.ResponseWriter, request *http.Request) {
+
+	response.Header().Add("X-Provided-By", server.hostString)
+
+	if request.Method != "GET" {
+		writeError(response, errorMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	if !server.isAdminRequest(request) {
+		log.Print("Received user activity request with incorrect admin key")
+		writeError(response, errorInvalidAdminKey, "Invalid admin key")
+		return
+	}
+
+	page, err := server.parsePagination(request, 100, 1000)
+	if err != nil {
+		log.Print("Received user activity request with invalid pagination: ", err)
+		writeError(response, errorInvalidParameter, "Invalid pagination: " + err.Error())
+		return
+	}
+
+	ctx, cancel, err := server.databaseContext(request)
+	if err != nil {
+		log.Print("Received user activity request with invalid query timeout: ", err)
+		writeError(response, errorInvalidQueryTimeout, "Invalid query timeout")
+		return
+	}
+
+	defer cancel()
+
+	log.Printf("Returning user activity with limit %d and offset %d", page.Limit, page.Offset)
+
+	activities, err := server.store.UserActivity(ctx, page)
+	if err != nil {
+		log.Print("Failed to query database for user activity: ", err)
+		writeError(response, errorDatabaseUnavailable, "Failed to query database")
+		return
+	}
+
+	lastUser := ""
+	if len(activities) > 0 {
+		lastUser = activities[len(activities) - 1].User
+	}
+
+	_, nextCursor := server.setPaginationHeaders(
+		response, request, page, len(activities), lastUser)
+
+	response.Header().Set("Content-Type", "application/json")
+	response.Write(paginatedJSON(request, "activities", activities, nextCursor))
+	return
+}
+
+// ---
+// Returns age parsed as Go duration (such as "36h") or as number of days with
+// a "d" suffix (such as "90d"), which must be positive.
+func parseAge(value string) (time.Duration, error) {
+	if rawDays, found := strings.CutSuffix(value, "d"); found {
+		days, err := strconv.Atoi(rawDays)
+		if err != nil || days < 1 {
+			return 0, fmt.Errorf("invalid number of days \"%s\"", rawDays)
+		}
+
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+
+	age, err := time.ParseDuration(value)
+	if err != nil || age <= 0 {
+		return 0, fmt.Errorf("invalid positive duration \"%s\"", value)
+	}
+
+	return age, nil
+}
+
+// ---
+// Deletes favorites older than the age specified by the "olderThan" query
+// parameter, for enforcing retention policies.
+func (server *favoritesServer) pruneHandler(
+	response http.ResponseWriter, request *http.Request) {
+
+	response.Header().Add("X-Provided-By", server.hostString)
+
+	if request.Method != "DELETE" {
+		writeError(response, errorMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	if !server.isAdminRequest(request) {
+		log.Print("Received prune request with incorrect admin key")
+		writeError(response, errorInvalidAdminKey, "Invalid admin key")
+		return
+	}
+
+	age, err := parseAge(request.URL.Query().Get("olderThan"))
+	if err != nil {
+		log.Print("Received prune request with invalid age: ", err)
+		writeError(
+			response, errorInvalidParameter,
+			"Query parameter olderThan must be a duration such as \"90d\" or \"36h\"")
+
+		return
+	}
+
+	ctx, cancel, err := server.databaseContext(request)
+	if err != nil {
+		log.Print("Received prune request with invalid query timeout: ", err)
+		writeError(response, errorInvalidQueryTimeout, "Invalid query timeout")
+		return
+	}
+
+	defer cancel()
+
+	before := time.Now().Add(-age)
+	log.Print("Deleting favorites added before ", before.UTC().Format(time.RFC3339))
+
+	deleted, err := server.store.PruneFavorites(ctx, before, 1000)
+	if err != nil {
+		log.Printf("Failed to prune favorites after deleting %d rows: %s", deleted, err)
+		writeError(response, errorDatabaseUnavailable, "Failed to write to database")
+		return
+	}
+
+	log.Printf("Pruned favorites older than %s, %d rows removed", age, deleted)
+
+	response.Header().Set("Content-Type", "application/json")
+	responseData, _ := json.Marshal(map[string]int64{"deleted": deleted})
+	response.Write(responseData)
+	return
+}
+
+// ---
+// Deletes all favorites of all users, intended for resetting demo environments.
+// Requires the "confirm" query parameter to be "true" to prevent accidents.
+func (server *favoritesServer) deleteAllHandler(
+	response http.ResponseWriter, request *http.Request) {
+
+	response.Header().Add("X-Provided-By", server.hostString)
+
+	if request.Method != "DELETE" {
+		writeError(response, errorMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	if !server.isAdminRequest(request) {
+		log.Print("Received delete all request with incorrect admin key")
+		writeError(response, errorInvalidAdminKey, "Invalid admin key")
+		return
+	}
+
+	if request.URL.Query().Get("confirm") != "true" {
+		log.Print("Received delete all request without confirmation")
+		writeError(response, errorInvalidParameter, "Query parameter confirm must be \"true\"")
+		return
+	}
+
+	ctx, cancel, err := server.databaseContext(request)
+	if err != nil {
+		log.Print("Received delete all request with invalid query timeout: ", err)
+		writeError(response, errorInvalidQueryTimeout, "Invalid query timeout")
+		return
+	}
+
+	defer cancel()
+
+	log.Print("WARNING: Deleting ALL favorites of ALL users as requested by administrator")
+
+	deleted, err := server.store.DeleteAll(ctx)
+	if err != nil {
+		log.Print("Failed to delete all favorites: ", err)
+		writeError(response, errorDatabaseUnavailable, "Failed to write to database")
+		return
+	}
+
+	log.Printf("WARNING: Deleted ALL favorites, %d rows removed", deleted)
+
+	response.Header().Set("Content-Type", "application/json")
+	responseData, _ := json.Marshal(map[string]int64{"deleted": deleted})
+	response.Write(responseData)
+	return
+}
+
+// ---
+// Returns whether writes are enabled, or pauses/resumes them if a JSON object
+// such as {"writesEnabled":false} is posted. State is kept in-memory and only
+// affects the server instance handling the request.
+func (server *favoritesServer) maintenanceHandler(
+	response http.ResponseWriter, request *http.Request) {
+
+	response.Header().Add("X-Provided-By", server.hostString)
+
+	if request.Method != "GET" && request.Method != "POST" {
+		writeError(response, errorMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	if !server.isAdminRequest(request) {
+		log.Print("Received maintenance request with incorrect admin key")
+		writeError(response, errorInvalidAdminKey, "Invalid admin key")
+		return
+	}
+
+	var state struct {
+		WritesEnabled *bool `json:"writesEnabled"`
+	}
+
+	if request.Method == "POST" {
+		defer request.Body.Close()
+		requestBody, err := ioutil.ReadAll(request.Body)
+		if err != nil {
+			log.Print("Failed to read body for maintenance request: ", err)
+			writeBodyReadError(response, err)
+			return
+		}
+
+		err = json.Unmarshal(requestBody, &state)
+		if err != nil || state.WritesEnabled == nil {
+			log.Print("Failed to parse body for maintenance request: ", err)
+			writeError(response, errorInvalidBody, "Failed to parse submitted body")
+			return
+		}
+
+		if *state.WritesEnabled {
+			log.Print("Resuming writes as requested by administrator")
+
+		} else {
+			log.Print("WARNING: Pausing writes for maintenance as requested by administrator")
+		}
+
+		server.writesPaused.Store(!*state.WritesEnabled)
+	}
+
+	writesEnabled, maintenanceEnd := server.writesEnabled(time.Now())
+	maintenanceData := map[string]interface{}{"writesEnabled": writesEnabled}
+	if !maintenanceEnd.IsZero() {
+		maintenanceData["maintenanceUntil"] = maintenanceEnd.UTC().Format(time.RFC3339)
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	responseData, _ := json.Marshal(maintenanceData)
+
+	response.Write(responseData)
+	return
+}
+
+// ---
+// Returns handler responding with 503 to API requests until the database has
+// been prepared, such as if it wasn't reachable when the server started.
+// Health end-points and metrics are still served.
+func (server *favoritesServer) withStoreReadiness(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if isAPIPath(request.URL.Path) && !server.storeReady.Load() {
+			response.Header().Add("X-Provided-By", server.hostString)
+			response.Header().Set("Retry-After", "5")
+			writeError(response, errorStoreNotReady, "Database is being prepared")
+			return
+		}
+
+		handler.ServeHTTP(response, request)
+	})
+}
+
+// ---
+// Counts API requests currently being handled, reported by health end-points
+// while draining during shutdown.
+func (server *favoritesServer) trackInFlight(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if isAPIPath(request.URL.Path) {
+			server.inFlightRequests.Add(1)
+			defer server.inFlightRequests.Add(-1)
+		}
+
+		handler.ServeHTTP(response, request)
+	})
+}
+
+// ---
+// Returns path as seen by clients, which includes the configured path prefix
+// stripped from requests before routing.
+func (server *favoritesServer) externalPath(path string) string {
+	return server.config.PathPrefix + path
+}
+
+// ---
+// Returns true for paths of API and share end-points, as opposed to health checks.
+func isAPIPath(path string) bool {
+	return (strings.HasPrefix(path, "/api/") || strings.HasPrefix(path, "/s/")) &&
+		!strings.HasPrefix(path, "/api/health")
+}
+
+// ---
+// Returns whether writes are enabled at time, which they aren't if paused by
+// an administrator or during a scheduled maintenance window. If in such a
+// window, its end is returned as well.
+func (server *favoritesServer) writesEnabled(now time.Time) (bool, time.Time) {
+	for _, window := range server.config.MaintenanceWindows {
+		if !now.Before(window.Start) && now.Before(window.End) {
+			return false, window.End
+		}
+	}
+
+	return !server.writesPaused.Load(), time.Time{}
+}
+
+// ---
+// Returns handler responding with 503 to requests using methods other than
+// GET, HEAD and OPTIONS while writes are paused for maintenance.
+func (server *favoritesServer) withWritePause(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		readOnly := request.Method == "GET" || request.Method == "HEAD" ||
+			request.Method == "OPTIONS"
+
+		writesEnabled, maintenanceEnd := server.writesEnabled(time.Now())
+		if !writesEnabled && !readOnly && request.URL.Path != "/api/admin/maintenance" {
+			log.Printf(
+				"Rejecting \"%s\" request to \"%s\" as writes are paused",
+				request.Method, request.URL.Path)
+
+			retryAfter := 60
+			if !maintenanceEnd.IsZero() {
+				retryAfter = int(math.Ceil(time.Until(maintenanceEnd).Seconds()))
+			}
+
+			response.Header().Add("X-Provided-By", server.hostString)
+			response.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			writeError(response, errorWritesPaused, "Writes are paused for maintenance")
+			return
+		}
+
+		handler.ServeHTTP(response, request)
+	})
+}
+
+// ---
+// Returns handlers for the favorites API and for health end-points, which are
+// the same if no dedicated admin address is configured.
+func (server *favoritesServer) routes() (http.Handler, http.Handler) {
+	apiMux := http.NewServeMux()
+	apiMux.HandleFunc("/api/favorites/", server.favoritesHandler)
+	apiMux.HandleFunc("/api/common", server.commonFavoritesHandler)
+	apiMux.HandleFunc("/api/diff", server.diffFavoritesHandler)
+	apiMux.HandleFunc("/api/drinks", server.drinksHandler)
+	apiMux.HandleFunc("/api/auth/check", server.authCheckHandler)
+	apiMux.HandleFunc("/api/count", server.countHandler)
+	apiMux.HandleFunc("/s/", server.sharedFavoritesHandler)
+	apiMux.HandleFunc("/api/admin/schema", server.schemaHandler)
+	apiMux.HandleFunc("/api/stats/active", server.activeUsersHandler)
+	apiMux.HandleFunc("/api/stats/users/activity", server.userActivityHandler)
+	apiMux.HandleFunc("/api/admin/all", server.deleteAllHandler)
+	apiMux.HandleFunc("/api/admin/prune", server.pruneHandler)
+	apiMux.HandleFunc("/api/admin/maintenance", server.maintenanceHandler)
+
+	adminMux := apiMux
+	if server.config.AdminAddress != "" {
+		adminMux = http.NewServeMux()
+	}
+
+	adminMux.HandleFunc("/", server.healthHandler)
+	adminMux.HandleFunc("/api/health", server.healthJSONHandler)
+	adminMux.HandleFunc("/api/health/deep", server.deepHealthHandler)
+	adminMux.Handle("/metrics", promhttp.Handler())
+
+	if server.config.EnableDebug {
+		log.Print("Exposing debug counters on \"/debug/vars\"")
+		adminMux.Handle("/debug/vars", expvar.Handler())
+	}
+
+	apiHandler := server.trackInFlight(
+		server.withStoreReadiness(server.withWritePause(measureResponseSizes(apiMux))))
+	if server.config.DebugLogBodies {
+		log.Print(
+			"WARNING: Logging of request and response bodies is enabled, " +
+			"logs may contain personal information!")
+
+		apiHandler = withBodyLogging(
+			apiHandler, server.config.DebugLogBodyLimit,
+			[]string{
+				server.config.AccessKey, server.config.ReadOnlyAccessKey,
+				server.config.AdminKey})
+	}
+
+	apiHandler = withRequestDecompression(apiHandler, int64(server.config.MaxBodyBytes))
+	if len(server.config.Compression) > 0 {
+		apiHandler = withCompression(apiHandler, server.config.Compression)
+	}
+
+	apiHandler = labelRequests(apiHandler, apiMux)
+	if server.config.PathPrefix != "" {
+		apiHandler = http.StripPrefix(server.config.PathPrefix, apiHandler)
+	}
+
+	if server.config.MaxConnectionsPerIP > 0 && len(server.config.TrustedProxies) > 0 {
+		apiHandler = withProxiedClientLimit(
+			apiHandler, server.config.MaxConnectionsPerIP, server.config.TrustedProxies)
+	}
+
+	timeout := server.config.RequestTimeout
+	adminHandler := withLocalization(labelRequests(measureResponseSizes(adminMux), adminMux))
+	return countRequests(withRequestTimeout(withLocalization(apiHandler), timeout)),
+		countRequests(withRequestTimeout(adminHandler, timeout))
+}
+
+// ---
+func main() {
+	config, problems := loadConfig()
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			log.Print("Configuration problem: ", problem)
+		}
+
+		log.Fatalf("Invalid configuration, found %d problem(s) listed above", len(problems))
+	}
+
+	rqliteStore := openStore(config)
+	server := newFavoritesServer(config, rqliteStore)
+	apiHandler, adminHandler := server.routes()
+
+	server.prepareStoreInBackground(rqliteStore)
+
+	if config.EnableH2C {
+		log.Print("Enabling cleartext HTTP/2 (h2c) for favorites API")
+		apiHandler = h2c.NewHandler(apiHandler, &http2.Server{})
+	}
+
+	httpServers := []*http.Server{{
+		Addr: ":8000", Handler: apiHandler, MaxHeaderBytes: config.MaxHeaderBytes}}
+
+	if config.AdminAddress != "" {
+		httpServers = append(httpServers, &http.Server{
+			Addr: config.AdminAddress, Handler: adminHandler,
+			MaxHeaderBytes: config.MaxHeaderBytes})
+	}
+
+	signalCtx, stop := signal.NotifyContext(
+		context.Background(), syscall.SIGINT, syscall.SIGTERM)
+
+	defer stop()
+
+	serverErrors := make(chan error, len(httpServers))
+	for _, httpServer := range httpServers {
+		log.Printf(
+			"Starting favorites web server on %s listening on \"%s\"",
+			server.hostString, httpServer.Addr)
+
+		listener, err := net.Listen("tcp", httpServer.Addr)
+		if err != nil {
+			log.Fatalf("Failed to listen on \"%s\": %s", httpServer.Addr, err)
+		}
+
+		if config.MaxConnectionsPerIP > 0 {
+			listener = newConnectionLimitListener(
+				listener, config.MaxConnectionsPerIP, config.TrustedProxies)
+		}
+
+		go func(httpServer *http.Server, listener net.Listener) {
+			serverErrors <- httpServer.Serve(listener)
+		}(httpServer, listener)
+	}
+
+	select {
+	case err := <-serverErrors:
+		log.Fatal("Web server failed: ", err)
+	case <-signalCtx.Done():
+	}
+
+	log.Print("Received shutdown signal, gracefully shutting down web servers")
+	server.draining.Store(true)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+	defer cancel()
+
+	// The API server is shut down before the admin server, which keeps
+	// reporting progress of draining on health end-points until then
+	for _, httpServer := range httpServers {
+		if err := httpServer.Shutdown(shutdownCtx); err != nil {
+			log.Printf(
+				"Failed to gracefully shut down server on \"%s\": %s", httpServer.Addr, err)
+		}
+	}
 }
@@ -0,0 +1,217 @@
+// Prometheus metrics exposed on "/metrics" and expvar counters exposed on
+// "/debug/vars" (if enabled).
+
+package main
+
+import (
+	"log"
+	"sync"
+	"expvar"
+	"context"
+	"strconv"
+	"net/http"
+	"sync/atomic"
+	"runtime/debug"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var favoritesAddedCounter = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "favorites_added_total",
+		Help: "Number of favorites added, labeled by drink (or \"other\")."},
+	[]string{"drink"})
+
+var databaseWritesCounter = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "favorites_database_writes_total",
+		Help: "Number of database writes, labeled by mode (\"synchronous\" or \"queued\")."},
+	[]string{"mode"})
+
+var shadowWriteFailuresCounter = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "favorites_shadow_write_failures_total",
+		Help: "Number of writes which failed or were dropped when mirroring to shadow database."})
+
+// Buckets from 64 bytes to 1 MB, growing by a factor of 4, which covers both
+// small JSON responses and large lists of favorites.
+var responseBytesHistogram = promauto.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name: "favorites_response_bytes",
+		Help: "Size of response bodies in bytes, labeled by handler pattern.",
+		Buckets: prometheus.ExponentialBuckets(64, 4, 8)},
+	[]string{"handler"})
+
+// Label values are bounded by the handler patterns registered in muxes, see
+// labelRequests.
+var handlerRequestsCounter = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "favorites_http_requests_total",
+		Help: "Number of handled requests, labeled by handler pattern and final status code."},
+	[]string{"handler", "status"})
+
+var panicsRecoveredCounter = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "favorites_panics_recovered_total",
+		Help: "Number of panics recovered while handling requests, labeled by handler pattern."},
+	[]string{"handler"})
+
+var requestsCounter = expvar.NewInt("requests_total")
+var errorsCounter = expvar.NewInt("errors_total")
+var databaseCallsCounter = expvar.NewInt("database_calls_total")
+
+// ---
+// Wraps response writer to record the status code and body size of responses.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes int
+}
+
+// ---
+func (recorder *responseRecorder) WriteHeader(status int) {
+	if recorder.status == 0 {
+		recorder.status = status
+	}
+
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+// ---
+func (recorder *responseRecorder) Write(data []byte) (int, error) {
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+
+	written, err := recorder.ResponseWriter.Write(data)
+	recorder.bytes += written
+	return written, err
+}
+
+// ---
+func (recorder *responseRecorder) Unwrap() http.ResponseWriter {
+	return recorder.ResponseWriter
+}
+
+// ---
+type handlerLabelKey struct{}
+
+// ---
+// Counts handled requests and those resulting in server errors (5xx), labeled
+// by handler pattern recorded by labelRequests (or "unmatched"). Panics are
+// recovered and responded to with status 500, unless a response has already
+// been started. As the outermost middleware, the status counted is the one
+// actually sent, even if inner middleware (such as the timeout) replaced it.
+func countRequests(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		// Label is set by the goroutine of the timeout handler, hence atomic
+		label := &atomic.Value{}
+		label.Store("unmatched")
+		request = request.WithContext(
+			context.WithValue(request.Context(), handlerLabelKey{}, label))
+
+		recorder := &responseRecorder{ResponseWriter: response}
+		defer func() {
+			recovered := recover()
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+
+			if recovered != nil {
+				log.Printf(
+					"Recovered from panic handling request for \"%s\": %v\n%s",
+					request.URL.Path, recovered, debug.Stack())
+
+				panicsRecoveredCounter.WithLabelValues(label.Load().(string)).Inc()
+				if recorder.status == 0 {
+					writeError(recorder, errorInternal, "Internal server error")
+				}
+			}
+
+			// Status defaults to 200 if handler didn't write anything
+			status := max(recorder.status, http.StatusOK)
+			handlerRequestsCounter.WithLabelValues(
+				label.Load().(string), strconv.Itoa(status)).Inc()
+
+			requestsCounter.Add(1)
+			if status >= 500 {
+				errorsCounter.Add(1)
+			}
+		}()
+
+		handler.ServeHTTP(recorder, request)
+	})
+}
+
+// ---
+// Records pattern of handler registered in mux (such as "/api/favorites/") for
+// countRequests, before passing request to handler. Placed outside middleware
+// which may reject requests, so that those are attributed to their handlers.
+func labelRequests(handler http.Handler, mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if label, found := request.Context().Value(handlerLabelKey{}).(*atomic.Value); found {
+			if _, pattern := mux.Handler(request); pattern != "" {
+				label.Store(pattern)
+			}
+		}
+
+		handler.ServeHTTP(response, request)
+	})
+}
+
+// ---
+// Records size of response bodies per handler registered in mux, using its
+// pattern (such as "/api/favorites/") as label value to bound cardinality.
+func measureResponseSizes(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		_, pattern := mux.Handler(request)
+		if pattern == "" {
+			pattern = "unmatched"
+		}
+
+		recorder := &responseRecorder{ResponseWriter: response}
+		mux.ServeHTTP(recorder, request)
+		responseBytesHistogram.WithLabelValues(pattern).Observe(float64(recorder.bytes))
+	})
+}
+
+// ---
+// Limits the set of drink label values to keep metric cardinality bounded, as
+// drink names are submitted by clients. If an allow-list is configured, only
+// listed drinks are used as label values. Otherwise, the first drinks observed
+// are used, up to a maximum count. All other drinks are labeled "other".
+type drinkLabeler struct {
+	mutex sync.Mutex
+	allowList bool
+	maxDrinks int
+	drinks map[string]bool
+}
+
+// ---
+func newDrinkLabeler(allowedDrinks []string, maxDrinks int) *drinkLabeler {
+	labeler := &drinkLabeler{maxDrinks: maxDrinks, drinks: map[string]bool{}}
+
+	for _, drink := range allowedDrinks {
+		labeler.allowList = true
+		labeler.drinks[drink] = true
+	}
+
+	return labeler
+}
+
+// ---
+func (labeler *drinkLabeler) Label(drink string) string {
+	labeler.mutex.Lock()
+	defer labeler.mutex.Unlock()
+
+	if labeler.drinks[drink] {
+		return drink
+	}
+
+	if !labeler.allowList && len(labeler.drinks) < labeler.maxDrinks {
+		labeler.drinks[drink] = true
+		return drink
+	}
+
+	return "other"
+}
@@ -0,0 +1,67 @@
+// Mirroring of database writes to a second ("shadow") database, used while
+// migrating between rqlite clusters.
+
+package main
+
+import (
+	"log"
+	"time"
+	"context"
+	"github.com/rqlite/gorqlite"
+)
+
+// ---
+type shadowStatement struct {
+	queryType string
+	statement gorqlite.ParameterizedStatement
+}
+
+// ---
+// Applies statements to shadow database asynchronously, one at a time in the
+// order they were written to the primary database. Failures are logged and
+// counted, but otherwise ignored.
+type shadowWriter struct {
+	connection *gorqlite.Connection
+	timeout time.Duration
+	statements chan shadowStatement
+}
+
+// ---
+// Returns shadow writer buffering up to queueSize statements, which are
+// dropped (and counted as failures) if the shadow database can't keep up.
+func newShadowWriter(
+	connection *gorqlite.Connection, timeout time.Duration, queueSize int) *shadowWriter {
+
+	writer := &shadowWriter{
+		connection: connection, timeout: timeout,
+		statements: make(chan shadowStatement, queueSize)}
+
+	go writer.run()
+	return writer
+}
+
+// ---
+func (writer *shadowWriter) Mirror(queryType string, statement gorqlite.ParameterizedStatement) {
+	select {
+	case writer.statements <- shadowStatement{queryType: queryType, statement: statement}:
+	default:
+		log.Printf("Dropping shadow write of type \"%s\" as queue is full", queryType)
+		shadowWriteFailuresCounter.Inc()
+	}
+}
+
+// ---
+func (writer *shadowWriter) run() {
+	for statement := range writer.statements {
+		ctx, cancel := context.WithTimeout(context.Background(), writer.timeout)
+		writeResult, err := writer.connection.WriteOneParameterizedContext(
+			ctx, statement.statement)
+
+		cancel()
+
+		if err = resultError(err, writeResult.Err); err != nil {
+			log.Printf("Failed shadow write of type \"%s\": %s", statement.queryType, err)
+			shadowWriteFailuresCounter.Inc()
+		}
+	}
+}
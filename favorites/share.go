@@ -0,0 +1,66 @@
+// Time-limited tokens granting read-only access to favorites of a user without
+// access key, such as for sharing using QR codes.
+
+package main
+
+import (
+	"fmt"
+	"time"
+	"errors"
+	"strconv"
+	"strings"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+)
+
+// ---
+// Returns token for user expiring at specified time, consisting of encoded
+// username and expiry followed by an HMAC-SHA256 signature of them.
+func signShareToken(secret []byte, user string, expires time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString(
+		[]byte(user + ":" + strconv.FormatInt(expires.Unix(), 36)))
+
+	return payload + "." + shareTokenSignature(secret, payload)
+}
+
+// ---
+// Returns user of token if signature is valid and token hasn't expired.
+func verifyShareToken(secret []byte, token string, now time.Time) (string, error) {
+	payload, signature, found := strings.Cut(token, ".")
+	if !found {
+		return "", errors.New("token is missing signature")
+	}
+
+	if !hmac.Equal([]byte(signature), []byte(shareTokenSignature(secret, payload))) {
+		return "", errors.New("token signature is invalid")
+	}
+
+	decodedPayload, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return "", fmt.Errorf("token payload is invalid: %w", err)
+	}
+
+	separator := strings.LastIndex(string(decodedPayload), ":")
+	if separator < 0 {
+		return "", errors.New("token payload is missing expiry")
+	}
+
+	expires, err := strconv.ParseInt(string(decodedPayload[separator + 1:]), 36, 64)
+	if err != nil {
+		return "", fmt.Errorf("token expiry is invalid: %w", err)
+	}
+
+	if now.Unix() > expires {
+		return "", errors.New("token has expired")
+	}
+
+	return string(decodedPayload[:separator]), nil
+}
+
+// ---
+func shareTokenSignature(secret []byte, payload string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
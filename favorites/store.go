@@ -0,0 +1,1244 @@
+// Storage abstraction for favorites, enabling handlers to be used with
+// backends other than rqlite (such as in-memory fakes).
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+	"strings"
+	"context"
+	"github.com/rqlite/gorqlite"
+)
+
+type Store interface {
+	// Verifies that the storage backend is reachable and usable.
+	Ping(ctx context.Context) error
+
+	// Returns distinct drinks marked as favorite by user matching filter.
+	ListFavorites(ctx context.Context, user string, filter favoritesFilter) ([]string, error)
+
+	// Returns distinct categories used by user for favorites.
+	ListCategories(ctx context.Context, user string) ([]string, error)
+
+	// Returns up to limit drinks favorited by users sharing favorites with user,
+	// excluding favorites of user, ordered by number of such users.
+	Recommendations(ctx context.Context, user string, limit int) ([]string, error)
+
+	// Returns position of user among all users who favorited drink, ordered by
+	// when they first did so, and the number of such users. Rank is zero if
+	// the drink isn't a favorite of user.
+	DrinkRank(ctx context.Context, user string, drink string) (int64, int64, error)
+
+	// Returns distinct dates (in UTC) on which user added favorites, in
+	// ascending order.
+	FavoriteDates(ctx context.Context, user string) ([]time.Time, error)
+
+	// Returns drinks marked as favorite by all of the specified users.
+	CommonFavorites(ctx context.Context, users []string) ([]string, error)
+
+	// Marks drink as favorite for user, optionally in category (empty for none)
+	// and at timestamp (zero for current time). Returns identifier of the
+	// created favorite and whether it was created, which is false if a
+	// uniqueness constraint made the favorite be ignored.
+	AddFavorite(
+		ctx context.Context, user string, drink string, category string,
+		timestamp time.Time) (int64, bool, error)
+
+	// Like AddFavorite, but the favorite is added asynchronously by the storage
+	// backend, trading durability and error reporting for throughput.
+	QueueFavorite(
+		ctx context.Context, user string, drink string, category string,
+		timestamp time.Time) error
+
+	// Adds favorite identified by client-generated identifier, or updates the
+	// category of the favorite of user already having it with the same drink,
+	// making repeated submissions idempotent. Unless timestamp is set, existing
+	// favorites of user with drink but without identifier are adopted instead
+	// of being duplicated. Returns the stored favorite, whether it was created
+	// and false if the identifier is used by another user or for another drink.
+	UpsertFavorite(
+		ctx context.Context, user string, clientID string, drink string, category string,
+		timestamp time.Time) (favorite storedFavorite, created bool, stored bool, err error)
+
+	// Returns favorite of user with identifier and whether it exists.
+	GetFavorite(ctx context.Context, user string, id int64) (storedFavorite, bool, error)
+
+	// Returns whether favorite of user with identifier exists, using a
+	// strongly consistent read.
+	HasFavorite(ctx context.Context, user string, id int64) (bool, error)
+
+	// Removes favorite of user by identifier, returning false if it doesn't exist.
+	DeleteFavoriteByID(ctx context.Context, user string, id int64) (bool, error)
+
+	// Moves favorite drink of user to category (empty for none), returning false
+	// if the drink isn't a favorite of user.
+	UpdateCategory(
+		ctx context.Context, user string, drink string, category string) (bool, error)
+
+	// Returns up to limit distinct drinks (of any user) starting with prefix,
+	// ordered by number of favorites.
+	SuggestDrinks(ctx context.Context, prefix string, limit int) ([]string, error)
+
+	// Returns distinct users who added favorites after specified time.
+	ActiveUsers(ctx context.Context, since time.Time) ([]string, error)
+
+	// Returns when each user first and last added a favorite and how many
+	// favorites were added, ordered by user and paginated.
+	UserActivity(ctx context.Context, page pagination) ([]userActivity, error)
+
+	// Returns number of favorites matching filter, of all users if user is empty.
+	CountFavorites(ctx context.Context, user string, filter countFilter) (int64, error)
+
+	// Removes favorites added before specified time in batches of batchSize,
+	// returning number of removed favorites.
+	PruneFavorites(ctx context.Context, before time.Time, batchSize int) (int64, error)
+
+	// Removes all favorites of all users, returning number of removed favorites.
+	DeleteAll(ctx context.Context) (int64, error)
+
+	// Returns columns currently present in the favorites table.
+	Schema(ctx context.Context) ([]schemaColumn, error)
+}
+
+// Optional criteria for listing favorites, zero values match everything.
+type favoritesFilter struct {
+	Category string
+
+	// Window (inclusive) in which favorites were added, ignored unless both set.
+	From time.Time
+	To time.Time
+
+	// Pagination of drinks ordered by name, zero limit disables pagination.
+	pagination
+}
+
+// Pagination of ordered results, either by offset or by sort key of the last
+// result of the previous page ("after"), which avoids scanning skipped rows.
+type pagination struct {
+	Limit int
+	Offset int
+	After string
+}
+
+// Optional criteria for counting favorites, zero values match everything.
+type countFilter struct {
+	Drink string
+	Since time.Time
+}
+
+type storedFavorite struct {
+	ID int64 `json:"id"`
+	Drink string `json:"drink"`
+	Category string `json:"category"`
+	Timestamp time.Time `json:"timestamp"`
+	ClientID string `json:"clientId,omitempty"`
+}
+
+type userActivity struct {
+	User string `json:"user"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen time.Time `json:"lastSeen"`
+	Count int64 `json:"count"`
+}
+
+type schemaColumn struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	NotNull bool `json:"notNull"`
+	Default *string `json:"default"`
+	PrimaryKey bool `json:"primaryKey"`
+}
+
+// Format of timestamps stored by SQLite's CURRENT_TIMESTAMP (in UTC).
+const sqliteTimeFormat = "2006-01-02 15:04:05"
+
+// ---
+// Returns first non-nil error out of the one returned by a gorqlite call and
+// the one included in its result.
+func resultError(err error, resultErr error) error {
+	if err != nil {
+		return err
+	}
+
+	return resultErr
+}
+
+// ---
+// Returns values of the first column for all rows in query result.
+func scanStrings(queryRows gorqlite.QueryResult) ([]string, error) {
+	values := []string{}
+	for queryRows.Next() {
+		var value string
+
+		if err := queryRows.Scan(&value); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+
+		values = append(values, value)
+	}
+
+	return values, nil
+}
+
+// ---
+type rqliteStore struct {
+	connection *gorqlite.Connection
+
+	// Calls taking longer than threshold are logged, zero disables logging.
+	slowQueryThreshold time.Duration
+
+	// Usernames are lowercased on write and compared case-insensitively on read.
+	caseInsensitiveUsers bool
+
+	// Maximum number of attempts for writes failing due to transient errors.
+	writeAttempts int
+
+	// Delays between retried writes.
+	backoff backoffPolicy
+
+	// Read-only query used to verify that the database is usable.
+	healthQuery string
+
+	// Optional connection to read replica, used for listing queries.
+	readConnection *gorqlite.Connection
+
+	// Time (in Unix nanoseconds) until which read replica is considered unhealthy.
+	readConnectionUnhealthyUntil atomic.Int64
+
+	// Optional writer mirroring successful writes to a shadow database.
+	shadow *shadowWriter
+}
+
+// ---
+func newRqliteStore(connection *gorqlite.Connection) *rqliteStore {
+	return &rqliteStore{
+		connection: connection, writeAttempts: 1, healthQuery: "SELECT 1",
+		backoff: backoffPolicy{base: 100 * time.Millisecond, cap: 5 * time.Second}}
+}
+
+// ---
+// Logs a warning if database call started at specified time exceeded threshold.
+// Relies on the monotonic clock reading included in values returned by time.Now.
+func (store *rqliteStore) logIfSlow(queryType string, user string, started time.Time) {
+	duration := time.Since(started)
+	if store.slowQueryThreshold == 0 || duration < store.slowQueryThreshold {
+		return
+	}
+
+	log.Printf(
+		"WARNING: Slow database call of type \"%s\" for user \"%s\" took %s",
+		queryType, user, duration)
+}
+
+// ---
+type consistencyRecorderKey struct{}
+
+// ---
+// Returns context in which the rqlite consistency level used by queries is
+// recorded into the returned string, useful for debugging of stale reads.
+func withConsistencyRecorder(ctx context.Context) (context.Context, *string) {
+	consistency := new(string)
+	return context.WithValue(ctx, consistencyRecorderKey{}, consistency), consistency
+}
+
+// ---
+func recordConsistency(ctx context.Context, consistency string) {
+	if recorder, found := ctx.Value(consistencyRecorderKey{}).(*string); found {
+		*recorder = consistency
+	}
+}
+
+// ---
+func (store *rqliteStore) queryOne(
+	ctx context.Context, queryType string, user string,
+	statement gorqlite.ParameterizedStatement) (gorqlite.QueryResult, error) {
+
+	defer store.logIfSlow(queryType, user, time.Now())
+	databaseCallsCounter.Add(1)
+	recordConsistency(ctx, "strong")
+
+	queryRows, err := store.connection.QueryOneParameterizedContext(ctx, statement)
+	return queryRows, resultError(err, queryRows.Err)
+}
+
+// ---
+// Executes query using read replica if configured and healthy, otherwise using
+// the primary connection. Replicas failing due to transient errors are
+// considered unhealthy for 30 seconds, during which the primary is used.
+func (store *rqliteStore) readOne(
+	ctx context.Context, queryType string, user string,
+	statement gorqlite.ParameterizedStatement) (gorqlite.QueryResult, error) {
+
+	if store.readConnection == nil ||
+		time.Now().UnixNano() < store.readConnectionUnhealthyUntil.Load() {
+
+		return store.queryOne(ctx, queryType, user, statement)
+	}
+
+	started := time.Now()
+	databaseCallsCounter.Add(1)
+
+	queryRows, err := store.readConnection.QueryOneParameterizedContext(ctx, statement)
+	err = resultError(err, queryRows.Err)
+	store.logIfSlow(queryType, user, started)
+
+	if err == nil || !isTransientError(err) {
+		recordConsistency(ctx, "none")
+		return queryRows, err
+	}
+
+	log.Print("Read replica failed, falling back to primary for 30 seconds: ", err)
+	store.readConnectionUnhealthyUntil.Store(time.Now().Add(30 * time.Second).UnixNano())
+	return store.queryOne(ctx, queryType, user, statement)
+}
+
+// ---
+// Returns true if error is likely to be resolved by retrying the operation,
+// such as failures to reach the database, unavailability of the cluster or
+// changes of cluster leader. Errors caused by the statement itself (such as
+// constraint violations) or by the request (such as failed authentication) are
+// not. Note that gorqlite reports failed requests as plain text only.
+func isTransientError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	if errors.Is(err, gorqlite.ErrClosed) {
+		return false
+	}
+
+	var statementErrors gorqlite.StatementErrors
+	if errors.As(err, &statementErrors) {
+		return strings.Contains(strings.ToLower(err.Error()), "leader")
+	}
+
+	message := err.Error()
+	if !strings.Contains(message, "tried all peers unsuccessfully") {
+		return false
+	}
+
+	return strings.Contains(message, "failed due to") ||
+		strings.Contains(message, "got: 502") ||
+		strings.Contains(message, "got: 503") ||
+		strings.Contains(message, "got: 504")
+}
+
+// ---
+// Returns true if error is transient and shows that the request wasn't applied
+// by the database, as it couldn't be delivered or the cluster had no leader.
+// Errors such as timeouts leave it unknown whether it was applied.
+func isUndeliveredError(err error) bool {
+	if !isTransientError(err) {
+		return false
+	}
+
+	message := strings.ToLower(err.Error())
+	for _, undelivered := range []string{
+		"leader", "connection refused", "no such host", "got: 503"} {
+
+		if strings.Contains(message, undelivered) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ---
+// Returns true if error is caused by adding a column that already exists.
+func isDuplicateColumnError(err error) bool {
+	var statementErrors gorqlite.StatementErrors
+	if !errors.As(err, &statementErrors) {
+		return false
+	}
+
+	return strings.Contains(strings.ToLower(err.Error()), "duplicate column name")
+}
+
+// ---
+// Executes idempotent write, retrying with jittered exponential backoff upon
+// transient errors. A retried write may have been applied already if only the
+// response was lost, so non-idempotent writes must use insertOne instead.
+func (store *rqliteStore) writeOne(
+	ctx context.Context, queryType string, user string,
+	statement gorqlite.ParameterizedStatement) (gorqlite.WriteResult, error) {
+
+	return store.write(ctx, queryType, user, statement, isTransientError)
+}
+
+// ---
+// Executes non-idempotent write, such as an insertion, only retrying if it
+// wasn't delivered to the database.
+func (store *rqliteStore) insertOne(
+	ctx context.Context, queryType string, user string,
+	statement gorqlite.ParameterizedStatement) (gorqlite.WriteResult, error) {
+
+	return store.write(ctx, queryType, user, statement, isUndeliveredError)
+}
+
+// ---
+// Executes write, retrying with jittered exponential backoff upon errors for
+// which retryable returns true.
+func (store *rqliteStore) write(
+	ctx context.Context, queryType string, user string,
+	statement gorqlite.ParameterizedStatement,
+	retryable func(err error) bool) (gorqlite.WriteResult, error) {
+
+	defer store.logIfSlow(queryType, user, time.Now())
+	databaseWritesCounter.WithLabelValues("synchronous").Inc()
+
+	for attempt := 1; ; attempt++ {
+		databaseCallsCounter.Add(1)
+		writeResult, err := store.connection.WriteOneParameterizedContext(ctx, statement)
+		err = resultError(err, writeResult.Err)
+
+		if err == nil && store.shadow != nil {
+			store.shadow.Mirror(queryType, statement)
+		}
+
+		if err == nil || attempt >= store.writeAttempts || !retryable(err) {
+			return writeResult, err
+		}
+
+		delay := store.backoff.Delay(attempt - 1)
+		log.Printf(
+			"Retrying database write of type \"%s\" in %s after attempt %d failed: %s",
+			queryType, delay, attempt, err)
+
+		select {
+		case <-ctx.Done():
+			return writeResult, err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// ---
+// Enqueues write, which is applied asynchronously by rqlite. Failures to apply
+// the write are not reported, so it isn't retried.
+func (store *rqliteStore) queueOne(
+	ctx context.Context, queryType string, user string,
+	statement gorqlite.ParameterizedStatement) error {
+
+	defer store.logIfSlow(queryType, user, time.Now())
+	databaseCallsCounter.Add(1)
+	databaseWritesCounter.WithLabelValues("queued").Inc()
+
+	_, err := store.connection.QueueOneParameterizedContext(ctx, statement)
+	if err == nil && store.shadow != nil {
+		store.shadow.Mirror(queryType, statement)
+	}
+
+	return err
+}
+
+// ---
+// Returns SQL expression used for matching the "user" column against a parameter.
+func (store *rqliteStore) userColumn() string {
+	if store.caseInsensitiveUsers {
+		return "LOWER(user)"
+	}
+
+	return "user"
+}
+
+// ---
+// Returns SQL placeholder expression for username parameters, which is used both
+// when matching and storing users to ensure that they are normalized the same way.
+func (store *rqliteStore) userParameter() string {
+	if store.caseInsensitiveUsers {
+		return "LOWER(?)"
+	}
+
+	return "?"
+}
+
+// ---
+func (store *rqliteStore) CreateTable(ctx context.Context) error {
+	_, err := store.writeOne(ctx, "create table", "", gorqlite.ParameterizedStatement{
+		Query: `
+			CREATE TABLE IF NOT EXISTS "favorites"
+			("id" INTEGER, "timestamp" DATETIME DEFAULT CURRENT_TIMESTAMP,
+			"user" TEXT, "drink" TEXT, PRIMARY KEY ("id" AUTOINCREMENT))`,})
+
+	return err
+}
+
+// ---
+// Sample favorites inserted by SeedIfEmpty, as user/drink pairs.
+var seedFavorites = [][2]string{
+	{"ada", "Negroni"}, {"ada", "Screwdriver"}, {"ada", "Old Fashioned"},
+	{"bob", "Screwdriver"}, {"bob", "Mojito"}, {"bob", "Americano"},
+	{"eve", "Negroni"}, {"eve", "Mojito"},}
+
+// ---
+// Inserts sample favorites if the table is empty, returning whether it did so.
+// Checking for rows and inserting is done in a single statement to avoid
+// clobbering data if several replicas start at the same time.
+func (store *rqliteStore) SeedIfEmpty(ctx context.Context) (bool, error) {
+	values := []string{}
+	arguments := []interface{}{}
+	for _, favorite := range seedFavorites {
+		values = append(values, "(?, ?)")
+		arguments = append(arguments, favorite[0], favorite[1])
+	}
+
+	writeResult, err := store.writeOne(ctx, "seed", "", gorqlite.ParameterizedStatement{
+		Query: fmt.Sprintf(
+			`INSERT INTO favorites (user, drink) SELECT * FROM (VALUES %s)
+			WHERE NOT EXISTS (SELECT 1 FROM favorites)`, strings.Join(values, ", ")),
+		Arguments: arguments,})
+
+	if err != nil {
+		return false, err
+	}
+
+	return writeResult.RowsAffected > 0, nil
+}
+
+// ---
+// Columns added after the initial table definition, which are created by
+// Migrate if missing in the existing table. SQLite can't add columns with
+// unique constraints, which are instead enforced by migrationIndexes.
+var migrationColumns = []struct {
+	name string
+	definition string
+}{
+	{"category", "TEXT"},
+	// Optional identifier (UUID) generated by offline-first clients, see UpsertFavorite
+	{"client_id", "TEXT"},
+}
+
+// ---
+// Indexes created by Migrate if missing. Unique indexes permit several rows
+// with NULL values, so favorites without client identifiers are unaffected.
+var migrationIndexes = []struct {
+	name string
+	statement string
+}{
+	{"favorites_client_id", `
+		CREATE UNIQUE INDEX IF NOT EXISTS "favorites_client_id"
+		ON "favorites" ("client_id")`},
+}
+
+// ---
+// Adds columns and indexes missing in the favorites table.
+func (store *rqliteStore) Migrate(ctx context.Context) error {
+	columns, err := store.Schema(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to query existing columns: %w", err)
+	}
+
+	existingColumns := map[string]bool{}
+	for _, column := range columns {
+		existingColumns[column.Name] = true
+	}
+
+	for _, column := range migrationColumns {
+		if existingColumns[column.name] {
+			continue
+		}
+
+		log.Printf("Adding column \"%s\" to favorites table", column.name)
+		_, err := store.writeOne(ctx, "migrate", "", gorqlite.ParameterizedStatement{
+			Query: fmt.Sprintf(
+				`ALTER TABLE "favorites" ADD COLUMN "%s" %s`, column.name, column.definition),})
+
+		// Another replica starting concurrently may have added the column already
+		if isDuplicateColumnError(err) {
+			log.Printf("Column \"%s\" was added concurrently, skipping it", column.name)
+			continue
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to add column \"%s\": %w", column.name, err)
+		}
+	}
+
+	for _, index := range migrationIndexes {
+		_, err := store.writeOne(ctx, "migrate", "", gorqlite.ParameterizedStatement{
+			Query: index.statement,})
+
+		if err != nil {
+			return fmt.Errorf("failed to create index \"%s\": %w", index.name, err)
+		}
+	}
+
+	return nil
+}
+
+// ---
+// Returns argument for optional text column, nil (NULL) if value is empty.
+func nullableArgument(value string) interface{} {
+	if value == "" {
+		return nil
+	}
+
+	return value
+}
+
+// ---
+func (store *rqliteStore) Ping(ctx context.Context) error {
+	_, err := store.queryOne(ctx, "ping", "", gorqlite.ParameterizedStatement{
+		Query: store.healthQuery,})
+
+	return err
+}
+
+// ---
+// Runs trivial queries concurrently to establish connections to the database
+// (and read replica, if configured) before traffic is served.
+func (store *rqliteStore) Warmup(ctx context.Context, queries int) error {
+	connections := []*gorqlite.Connection{store.connection}
+	if store.readConnection != nil {
+		connections = append(connections, store.readConnection)
+	}
+
+	var waitGroup sync.WaitGroup
+	queryErrors := make(chan error, len(connections) * queries)
+
+	for _, connection := range connections {
+		for query := 0; query < queries; query++ {
+			waitGroup.Add(1)
+			go func(connection *gorqlite.Connection) {
+				defer waitGroup.Done()
+				queryRows, err := connection.QueryOneParameterizedContext(
+					ctx, gorqlite.ParameterizedStatement{Query: "SELECT 1"})
+
+				queryErrors <- resultError(err, queryRows.Err)
+			}(connection)
+		}
+	}
+
+	waitGroup.Wait()
+	close(queryErrors)
+
+	for err := range queryErrors {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ---
+func (store *rqliteStore) ListFavorites(
+	ctx context.Context, user string, filter favoritesFilter) ([]string, error) {
+
+	query := fmt.Sprintf(
+		"SELECT DISTINCT drink FROM favorites WHERE %s = %s",
+		store.userColumn(), store.userParameter())
+
+	arguments := []interface{}{user}
+
+	if filter.Category != "" {
+		query += " AND category = ?"
+		arguments = append(arguments, filter.Category)
+	}
+
+	if !filter.From.IsZero() && !filter.To.IsZero() {
+		query += " AND timestamp BETWEEN ? AND ?"
+		arguments = append(
+			arguments, filter.From.UTC().Format(sqliteTimeFormat),
+			filter.To.UTC().Format(sqliteTimeFormat))
+	}
+
+	if filter.After != "" {
+		query += " AND drink > ?"
+		arguments = append(arguments, filter.After)
+	}
+
+	if filter.Limit > 0 {
+		query += " ORDER BY drink LIMIT ? OFFSET ?"
+		arguments = append(arguments, filter.Limit, filter.Offset)
+	}
+
+	queryRows, err := store.readOne(ctx, "list favorites", user, gorqlite.ParameterizedStatement{
+		Query: query, Arguments: arguments,})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return scanStrings(queryRows)
+}
+
+// ---
+// Users are counted after normalization by the database, so users only
+// differing by case count once if they are case-insensitive.
+func (store *rqliteStore) CommonFavorites(
+	ctx context.Context, users []string) ([]string, error) {
+
+	arguments := []interface{}{}
+	for range 2 {
+		for _, user := range users {
+			arguments = append(arguments, user)
+		}
+	}
+
+	placeholders := strings.TrimSuffix(
+		strings.Repeat(store.userParameter() + ", ", len(users)), ", ")
+
+	userRows := strings.TrimSuffix(
+		strings.Repeat("SELECT " + store.userParameter() + " AS user UNION ", len(users)),
+		" UNION ")
+
+	queryRows, err := store.readOne(
+		ctx, "common favorites", strings.Join(users, ","), gorqlite.ParameterizedStatement{
+			Query: fmt.Sprintf(
+				`SELECT drink FROM favorites WHERE %s IN (%s) GROUP BY drink
+				HAVING COUNT(DISTINCT %s) = (SELECT COUNT(*) FROM (%s)) ORDER BY drink`,
+				store.userColumn(), placeholders, store.userColumn(), userRows),
+			Arguments: arguments,})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return scanStrings(queryRows)
+}
+
+// ---
+func (store *rqliteStore) ListCategories(ctx context.Context, user string) ([]string, error) {
+	queryRows, err := store.readOne(ctx, "list categories", user, gorqlite.ParameterizedStatement{
+		Query: fmt.Sprintf(
+			`SELECT DISTINCT category FROM favorites
+			WHERE %s = %s AND category IS NOT NULL ORDER BY category`,
+			store.userColumn(), store.userParameter()),
+		Arguments: []interface{}{user},})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return scanStrings(queryRows)
+}
+
+// ---
+// Users are considered similar if they share at least one favorite with user.
+// Their other drinks are ranked by how many similar users favorited them.
+func (store *rqliteStore) Recommendations(
+	ctx context.Context, user string, limit int) ([]string, error) {
+
+	userColumn, userParameter := store.userColumn(), store.userParameter()
+	queryRows, err := store.readOne(ctx, "recommendations", user, gorqlite.ParameterizedStatement{
+		Query: fmt.Sprintf(
+			`WITH own AS (SELECT DISTINCT drink FROM favorites WHERE %s = %s),
+			similar AS (
+				SELECT DISTINCT %s AS user FROM favorites
+				WHERE drink IN (SELECT drink FROM own) AND %s != %s)
+			SELECT drink FROM favorites
+			WHERE %s IN (SELECT user FROM similar) AND drink NOT IN (SELECT drink FROM own)
+			GROUP BY drink ORDER BY COUNT(DISTINCT %s) DESC, drink LIMIT ?`,
+			userColumn, userParameter, userColumn, userColumn, userParameter,
+			userColumn, userColumn),
+		Arguments: []interface{}{user, user, limit},})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return scanStrings(queryRows)
+}
+
+// ---
+// Ties of users favoriting drink at the same time (timestamps have a precision
+// of seconds) are broken by order of insertion.
+func (store *rqliteStore) DrinkRank(
+	ctx context.Context, user string, drink string) (int64, int64, error) {
+
+	queryRows, err := store.readOne(ctx, "drink rank", user, gorqlite.ParameterizedStatement{
+		Query: fmt.Sprintf(
+			`WITH firsts AS (
+				SELECT %s AS user, MIN(timestamp) AS first, MIN(id) AS first_id
+				FROM favorites WHERE drink = ? GROUP BY 1),
+			ranked AS (
+				SELECT user, ROW_NUMBER() OVER (ORDER BY first, first_id) AS rank,
+				COUNT(*) OVER () AS total FROM firsts)
+			SELECT rank, total FROM ranked WHERE user = %s`,
+			store.userColumn(), store.userParameter()),
+		Arguments: []interface{}{drink, user},})
+
+	if err != nil || !queryRows.Next() {
+		return 0, 0, err
+	}
+
+	var rank, total int64
+	if err := queryRows.Scan(&rank, &total); err != nil {
+		return 0, 0, fmt.Errorf("failed to scan row: %w", err)
+	}
+
+	return rank, total, nil
+}
+
+// ---
+func (store *rqliteStore) FavoriteDates(ctx context.Context, user string) ([]time.Time, error) {
+	queryRows, err := store.readOne(ctx, "favorite dates", user, gorqlite.ParameterizedStatement{
+		Query: fmt.Sprintf(
+			`SELECT DISTINCT date(timestamp) FROM favorites WHERE %s = %s ORDER BY 1`,
+			store.userColumn(), store.userParameter()),
+		Arguments: []interface{}{user},})
+
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := scanStrings(queryRows)
+	if err != nil {
+		return nil, err
+	}
+
+	dates := []time.Time{}
+	for _, value := range values {
+		date, err := time.Parse(time.DateOnly, value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse date \"%s\": %w", value, err)
+		}
+
+		dates = append(dates, date)
+	}
+
+	return dates, nil
+}
+
+// ---
+// Duplicates are ignored rather than causing errors if a unique constraint
+// (such as on user and drink) exists, which the table has none of by default.
+func (store *rqliteStore) AddFavorite(
+	ctx context.Context, user string, drink string, category string,
+	timestamp time.Time) (int64, bool, error) {
+
+	writeResult, err := store.insertOne(
+		ctx, "add favorite", user, store.addFavoriteStatement(user, drink, category, timestamp))
+
+	if err != nil {
+		return 0, false, err
+	}
+
+	return writeResult.LastInsertID, writeResult.RowsAffected > 0, nil
+}
+
+// ---
+func (store *rqliteStore) QueueFavorite(
+	ctx context.Context, user string, drink string, category string,
+	timestamp time.Time) error {
+
+	return store.queueOne(
+		ctx, "queue favorite", user, store.addFavoriteStatement(user, drink, category, timestamp))
+}
+
+// ---
+// Returns argument for timestamp of added favorite, which is nil (for the
+// current time of the database) if timestamp is zero. If writes are mirrored,
+// the current time of the server is used instead, so that timestamps match
+// between the databases (see DeleteFavoriteByID).
+func (store *rqliteStore) timestampArgument(timestamp time.Time) interface{} {
+	if timestamp.IsZero() && store.shadow != nil {
+		timestamp = time.Now()
+	}
+
+	if timestamp.IsZero() {
+		return nil
+	}
+
+	return timestamp.UTC().Format(sqliteTimeFormat)
+}
+
+// ---
+func (store *rqliteStore) addFavoriteStatement(
+	user string, drink string, category string,
+	timestamp time.Time) gorqlite.ParameterizedStatement {
+
+	timestampArgument := store.timestampArgument(timestamp)
+
+	return gorqlite.ParameterizedStatement{
+		Query: fmt.Sprintf(`
+			INSERT OR IGNORE INTO favorites (user, drink, category, timestamp)
+			VALUES (%s, ?, ?, COALESCE(?, CURRENT_TIMESTAMP))`,
+			store.userParameter()),
+		Arguments: []interface{}{user, drink, nullableArgument(category), timestampArgument},}
+}
+
+// ---
+// The conflicting favorite is only updated if it belongs to the same user and
+// has the same drink, as client identifiers are supplied by (potentially
+// misbehaving) clients. Upon re-submission the original timestamp is kept.
+// Each statement is idempotent, so they're retried upon transient errors, but
+// a favorite created by a retried insertion is reported as already existing.
+func (store *rqliteStore) UpsertFavorite(
+	ctx context.Context, user string, clientID string, drink string, category string,
+	timestamp time.Time) (storedFavorite, bool, bool, error) {
+
+	// The earliest favorite without identifier is adopted, unless it's a
+	// backfill, as those are distinct from favorites at other times
+	if timestamp.IsZero() {
+		_, err := store.writeOne(ctx, "adopt favorite", user, gorqlite.ParameterizedStatement{
+			Query: fmt.Sprintf(`
+				UPDATE favorites SET client_id = ?, category = ?
+				WHERE id = (
+					SELECT MIN(id) FROM favorites
+					WHERE client_id IS NULL AND drink = ? AND %s = %s)
+				AND NOT EXISTS (SELECT 1 FROM favorites WHERE client_id = ?)`,
+				store.userColumn(), store.userParameter()),
+			Arguments: []interface{}{
+				clientID, nullableArgument(category), drink, user, clientID},})
+
+		if err != nil {
+			return storedFavorite{}, false, false, err
+		}
+	}
+
+	writeResult, err := store.writeOne(ctx, "upsert favorite", user, gorqlite.ParameterizedStatement{
+		Query: fmt.Sprintf(`
+			INSERT INTO favorites (user, drink, category, client_id, timestamp)
+			VALUES (%s, ?, ?, ?, COALESCE(?, CURRENT_TIMESTAMP))
+			ON CONFLICT (client_id) DO NOTHING`,
+			store.userParameter()),
+		Arguments: []interface{}{
+			user, drink, nullableArgument(category), clientID,
+			store.timestampArgument(timestamp)},})
+
+	if err != nil {
+		return storedFavorite{}, false, false, err
+	}
+
+	created := writeResult.RowsAffected > 0
+	if !created {
+		_, err = store.writeOne(ctx, "upsert favorite", user, gorqlite.ParameterizedStatement{
+			Query: fmt.Sprintf(
+				`UPDATE favorites SET category = ? WHERE client_id = ? AND drink = ? AND %s = %s`,
+				store.userColumn(), store.userParameter()),
+			Arguments: []interface{}{nullableArgument(category), clientID, drink, user},})
+
+		if err != nil {
+			return storedFavorite{}, false, false, err
+		}
+	}
+
+	// Read from leader, as the row was just written
+	queryRows, err := store.queryOne(ctx, "get favorite", user, gorqlite.ParameterizedStatement{
+		Query: fmt.Sprintf(
+			`SELECT %s FROM favorites WHERE client_id = ? AND drink = ? AND %s = %s`,
+			storedFavoriteColumns, store.userColumn(), store.userParameter()),
+		Arguments: []interface{}{clientID, drink, user},})
+
+	if err != nil || !queryRows.Next() {
+		return storedFavorite{}, false, false, err
+	}
+
+	favorite, stored, err := scanStoredFavorite(queryRows)
+	return favorite, created, stored, err
+}
+
+// ---
+func (store *rqliteStore) GetFavorite(
+	ctx context.Context, user string, id int64) (storedFavorite, bool, error) {
+
+	queryRows, err := store.readOne(ctx, "get favorite", user, gorqlite.ParameterizedStatement{
+		Query: fmt.Sprintf(
+			`SELECT %s FROM favorites WHERE id = ? AND %s = %s`,
+			storedFavoriteColumns, store.userColumn(), store.userParameter()),
+		Arguments: []interface{}{id, user},})
+
+	if err != nil || !queryRows.Next() {
+		return storedFavorite{}, false, err
+	}
+
+	return scanStoredFavorite(queryRows)
+}
+
+// Columns selected for scanStoredFavorite.
+const storedFavoriteColumns = `
+	id, drink, category, strftime('%Y-%m-%d %H:%M:%S', timestamp), client_id`
+
+// ---
+// Scans current row, selected using storedFavoriteColumns, into favorite.
+func scanStoredFavorite(queryRows gorqlite.QueryResult) (storedFavorite, bool, error) {
+	var favorite storedFavorite
+	var category, timestamp, clientID gorqlite.NullString
+
+	err := queryRows.Scan(&favorite.ID, &favorite.Drink, &category, &timestamp, &clientID)
+	if err != nil {
+		return storedFavorite{}, false, fmt.Errorf("failed to scan row: %w", err)
+	}
+
+	favorite.Category = category.String
+	favorite.ClientID = clientID.String
+	if timestamp.Valid {
+		favorite.Timestamp, err = time.Parse(sqliteTimeFormat, timestamp.String)
+		if err != nil {
+			return storedFavorite{}, false, fmt.Errorf(
+				"failed to parse timestamp \"%s\": %w", timestamp.String, err)
+		}
+	}
+
+	return favorite, true, nil
+}
+
+// ---
+// Queries the primary database rather than read replica to ensure consistency.
+func (store *rqliteStore) HasFavorite(ctx context.Context, user string, id int64) (bool, error) {
+	queryRows, err := store.queryOne(ctx, "has favorite", user, gorqlite.ParameterizedStatement{
+		Query: fmt.Sprintf(
+			"SELECT id FROM favorites WHERE id = ? AND %s = %s",
+			store.userColumn(), store.userParameter()),
+		Arguments: []interface{}{id, user},})
+
+	if err != nil {
+		return false, err
+	}
+
+	return queryRows.NumRows() > 0, nil
+}
+
+// ---
+// Identifiers differ between the primary and shadow databases, so if writes are
+// mirrored the favorite is instead deleted by user, drink and timestamp (which
+// match, see timestampArgument) in both, preferring the row with identifier if
+// several rows match.
+func (store *rqliteStore) DeleteFavoriteByID(
+	ctx context.Context, user string, id int64) (bool, error) {
+
+	statement := gorqlite.ParameterizedStatement{
+		Query: fmt.Sprintf(
+			"DELETE FROM favorites WHERE id = ? AND %s = %s",
+			store.userColumn(), store.userParameter()),
+		Arguments: []interface{}{id, user},}
+
+	if store.shadow != nil {
+		queryRows, err := store.queryOne(ctx, "get favorite", user, gorqlite.ParameterizedStatement{
+			Query: fmt.Sprintf(
+				`SELECT user, drink, strftime('%%Y-%%m-%%d %%H:%%M:%%S', timestamp)
+				FROM favorites WHERE id = ? AND %s = %s`,
+				store.userColumn(), store.userParameter()),
+			Arguments: []interface{}{id, user},})
+
+		if err != nil || !queryRows.Next() {
+			return false, err
+		}
+
+		var storedUser, drink, timestamp string
+		if err := queryRows.Scan(&storedUser, &drink, &timestamp); err != nil {
+			return false, fmt.Errorf("failed to scan row: %w", err)
+		}
+
+		statement = gorqlite.ParameterizedStatement{
+			Query: `
+				DELETE FROM favorites WHERE id =
+				(SELECT id FROM favorites WHERE user = ? AND drink = ? AND
+				strftime('%Y-%m-%d %H:%M:%S', timestamp) = ?
+				ORDER BY id = ? DESC, id DESC LIMIT 1)`,
+			Arguments: []interface{}{storedUser, drink, timestamp, id},}
+	}
+
+	writeResult, err := store.writeOne(ctx, "delete favorite", user, statement)
+	if err != nil {
+		return false, err
+	}
+
+	return writeResult.RowsAffected > 0, nil
+}
+
+// ---
+func (store *rqliteStore) UpdateCategory(
+	ctx context.Context, user string, drink string, category string) (bool, error) {
+
+	writeResult, err := store.writeOne(ctx, "update category", user, gorqlite.ParameterizedStatement{
+		Query: fmt.Sprintf(
+			"UPDATE favorites SET category = ? WHERE %s = %s AND drink = ?",
+			store.userColumn(), store.userParameter()),
+		Arguments: []interface{}{nullableArgument(category), user, drink},})
+
+	if err != nil {
+		return false, err
+	}
+
+	return writeResult.RowsAffected > 0, nil
+}
+
+// ---
+// Prefix matching is case-insensitive for ASCII letters, as for LIKE in SQLite.
+func (store *rqliteStore) SuggestDrinks(
+	ctx context.Context, prefix string, limit int) ([]string, error) {
+
+	escapedPrefix := strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(prefix)
+
+	queryRows, err := store.readOne(ctx, "suggest drinks", "", gorqlite.ParameterizedStatement{
+		Query: `
+			SELECT drink FROM favorites WHERE drink LIKE ? ESCAPE '\'
+			GROUP BY drink ORDER BY COUNT(*) DESC, drink LIMIT ?`,
+		Arguments: []interface{}{escapedPrefix + "%", limit},})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return scanStrings(queryRows)
+}
+
+// ---
+func (store *rqliteStore) ActiveUsers(ctx context.Context, since time.Time) ([]string, error) {
+	queryRows, err := store.readOne(ctx, "active users", "", gorqlite.ParameterizedStatement{
+		Query: fmt.Sprintf(
+			"SELECT DISTINCT %s FROM favorites WHERE timestamp > ? ORDER BY 1",
+			store.userColumn()),
+		Arguments: []interface{}{since.UTC().Format(sqliteTimeFormat)},})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return scanStrings(queryRows)
+}
+
+// ---
+func (store *rqliteStore) UserActivity(
+	ctx context.Context, page pagination) ([]userActivity, error) {
+
+	// Users before the key are excluded by a condition that's always true otherwise
+	queryRows, err := store.readOne(ctx, "user activity", "", gorqlite.ParameterizedStatement{
+		Query: fmt.Sprintf(
+			`SELECT %s, strftime('%%Y-%%m-%%d %%H:%%M:%%S', MIN(timestamp)),
+			strftime('%%Y-%%m-%%d %%H:%%M:%%S', MAX(timestamp)), COUNT(*)
+			FROM favorites WHERE (? = '' OR %s > %s) GROUP BY 1 ORDER BY 1 LIMIT ? OFFSET ?`,
+			store.userColumn(), store.userColumn(), store.userParameter()),
+		Arguments: []interface{}{page.After, page.After, page.Limit, page.Offset},})
+
+	if err != nil {
+		return nil, err
+	}
+
+	activities := []userActivity{}
+	for queryRows.Next() {
+		var activity userActivity
+		var firstSeen, lastSeen string
+
+		err := queryRows.Scan(&activity.User, &firstSeen, &lastSeen, &activity.Count)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+
+		if activity.FirstSeen, err = time.Parse(sqliteTimeFormat, firstSeen); err != nil {
+			return nil, fmt.Errorf("failed to parse timestamp \"%s\": %w", firstSeen, err)
+		}
+
+		if activity.LastSeen, err = time.Parse(sqliteTimeFormat, lastSeen); err != nil {
+			return nil, fmt.Errorf("failed to parse timestamp \"%s\": %w", lastSeen, err)
+		}
+
+		activities = append(activities, activity)
+	}
+
+	return activities, nil
+}
+
+// ---
+func (store *rqliteStore) CountFavorites(
+	ctx context.Context, user string, filter countFilter) (int64, error) {
+
+	conditions := []string{"1 = 1"}
+	arguments := []interface{}{}
+
+	if user != "" {
+		conditions = append(
+			conditions, fmt.Sprintf("%s = %s", store.userColumn(), store.userParameter()))
+
+		arguments = append(arguments, user)
+	}
+
+	if filter.Drink != "" {
+		conditions = append(conditions, "drink = ?")
+		arguments = append(arguments, filter.Drink)
+	}
+
+	if !filter.Since.IsZero() {
+		conditions = append(conditions, "timestamp > ?")
+		arguments = append(arguments, filter.Since.UTC().Format(sqliteTimeFormat))
+	}
+
+	queryRows, err := store.readOne(ctx, "count favorites", user, gorqlite.ParameterizedStatement{
+		Query: "SELECT COUNT(*) FROM favorites WHERE " + strings.Join(conditions, " AND "),
+		Arguments: arguments,})
+
+	if err != nil {
+		return 0, err
+	}
+
+	var count int64
+	if queryRows.Next() {
+		if err := queryRows.Scan(&count); err != nil {
+			return 0, fmt.Errorf("failed to scan row: %w", err)
+		}
+	}
+
+	return count, nil
+}
+
+// ---
+// Favorites are deleted in batches to avoid long-running statements blocking
+// other writes, which also means that deletion is partial if a batch fails.
+func (store *rqliteStore) PruneFavorites(
+	ctx context.Context, before time.Time, batchSize int) (int64, error) {
+
+	var deleted int64
+	for {
+		statement := gorqlite.ParameterizedStatement{
+			Query: `
+				DELETE FROM favorites WHERE id IN
+				(SELECT id FROM favorites WHERE timestamp < ? LIMIT ?)`,
+			Arguments: []interface{}{before.UTC().Format(sqliteTimeFormat), batchSize},}
+
+		writeResult, err := store.writeOne(ctx, "prune favorites", "", statement)
+
+		deleted += writeResult.RowsAffected
+		if err != nil || writeResult.RowsAffected < int64(batchSize) {
+			return deleted, err
+		}
+	}
+}
+
+// ---
+func (store *rqliteStore) DeleteAll(ctx context.Context) (int64, error) {
+	writeResult, err := store.writeOne(ctx, "delete all", "", gorqlite.ParameterizedStatement{
+		Query: "DELETE FROM favorites",})
+
+	return writeResult.RowsAffected, err
+}
+
+// ---
+func (store *rqliteStore) Schema(ctx context.Context) ([]schemaColumn, error) {
+	queryRows, err := store.queryOne(ctx, "schema", "", gorqlite.ParameterizedStatement{
+		Query: `SELECT name, type, "notnull", dflt_value, pk FROM pragma_table_info('favorites')`,})
+
+	if err != nil {
+		return nil, err
+	}
+
+	columns := []schemaColumn{}
+	for queryRows.Next() {
+		var column schemaColumn
+		var notNull, primaryKey int64
+		var defaultValue gorqlite.NullString
+
+		err := queryRows.Scan(&column.Name, &column.Type, &notNull, &defaultValue, &primaryKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+
+		if defaultValue.Valid {
+			column.Default = &defaultValue.String
+		}
+
+		column.NotNull = notNull != 0
+		column.PrimaryKey = primaryKey != 0
+		columns = append(columns, column)
+	}
+
+	return columns, nil
+}
@@ -0,0 +1,282 @@
+// Tests of the rqlite storage backend, using a fake rqlite server.
+
+package main
+
+import (
+	"io"
+	"time"
+	"bytes"
+	"strings"
+	"context"
+	"testing"
+	"net/http"
+	"net/http/httptest"
+	"github.com/rqlite/gorqlite"
+)
+
+const (
+	fakeWriteResult = `{"results":[{"last_insert_id":1,"rows_affected":1}]}`
+	fakeQueryResult = `{"results":[{"columns":["drink"],"types":["text"],"values":[["Negroni"]]}]}`
+)
+
+// ---
+// Fake rqlite server responding to requests with scripted statuses, using the
+// last one for further requests, and successful results upon status 200.
+// Queries return a single row.
+type fakeRqlite struct {
+	statuses []int
+	requests int
+}
+
+// ---
+func (database *fakeRqlite) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	status := database.statuses[min(database.requests, len(database.statuses) - 1)]
+	database.requests++
+
+	response.WriteHeader(status)
+	if status == http.StatusOK && request.URL.Path == "/db/query" {
+		response.Write([]byte(fakeQueryResult))
+	} else if status == http.StatusOK {
+		response.Write([]byte(fakeWriteResult))
+	}
+}
+
+// ---
+// Returns store connected to fake rqlite server, retrying quickly.
+func newFakeRqliteStore(t *testing.T, database http.Handler) *rqliteStore {
+	server := httptest.NewServer(database)
+	t.Cleanup(server.Close)
+
+	connection, err := gorqlite.OpenWithClient(
+		server.URL + "?disableClusterDiscovery=true", server.Client())
+
+	if err != nil {
+		t.Fatalf("Failed to connect to fake rqlite server: %s", err)
+	}
+
+	store := newRqliteStore(connection)
+	store.writeAttempts = 3
+	store.backoff = backoffPolicy{base: time.Millisecond, cap: time.Millisecond}
+	return store
+}
+
+// ---
+func TestWritesAreOnlyRetriedUponTransientErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		statuses []int
+		requests int
+		fails bool
+	}{
+		{"success", []int{200}, 1, false},
+		{"unavailable", []int{503, 503, 200}, 3, false},
+		{"gateway timeout", []int{504, 200}, 2, false},
+		{"persistently unavailable", []int{503}, 3, true},
+		{"unauthorized", []int{401, 200}, 1, true},
+		{"bad request", []int{400, 200}, 1, true},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			database := &fakeRqlite{statuses: testCase.statuses}
+			store := newFakeRqliteStore(t, database)
+
+			_, err := store.UpdateCategory(context.Background(), "ada", "Negroni", "bitter")
+			if (err != nil) != testCase.fails {
+				t.Errorf("Expected failure to be %t, got error: %v", testCase.fails, err)
+			}
+
+			if database.requests != testCase.requests {
+				t.Errorf("Expected %d requests, got %d", testCase.requests, database.requests)
+			}
+		})
+	}
+}
+
+// ---
+func TestAdditionsAreOnlyRetriedIfUndelivered(t *testing.T) {
+	cases := []struct {
+		name string
+		statuses []int
+		requests int
+	}{
+		{"unavailable", []int{503, 200}, 2},
+		{"gateway timeout", []int{504, 200}, 1},
+		{"bad gateway", []int{502, 200}, 1},
+		{"unauthorized", []int{401, 200}, 1},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			database := &fakeRqlite{statuses: testCase.statuses}
+			store := newFakeRqliteStore(t, database)
+
+			store.AddFavorite(context.Background(), "ada", "Negroni", "", time.Time{})
+			if database.requests != testCase.requests {
+				t.Errorf("Expected %d requests, got %d", testCase.requests, database.requests)
+			}
+		})
+	}
+}
+
+// ---
+func TestRefusedConnectionsAreUndelivered(t *testing.T) {
+	server := httptest.NewServer(&fakeRqlite{statuses: []int{200}})
+	server.Close()
+
+	connection, err := gorqlite.OpenWithClient(
+		server.URL + "?disableClusterDiscovery=true", http.DefaultClient)
+
+	if err != nil {
+		t.Fatalf("Failed to create connection: %s", err)
+	}
+
+	store := newRqliteStore(connection)
+	store.backoff = backoffPolicy{base: time.Millisecond, cap: time.Millisecond}
+
+	_, _, err = store.AddFavorite(context.Background(), "ada", "Negroni", "", time.Time{})
+	if err == nil || !isUndeliveredError(err) {
+		t.Errorf("Expected refused connection to be undelivered, got error: %v", err)
+	}
+}
+
+// ---
+func TestUsersAreNormalizedIfCaseInsensitive(t *testing.T) {
+	cases := map[bool][2]string{false: {"user", "?"}, true: {"LOWER(user)", "LOWER(?)"}}
+	for caseInsensitive, expected := range cases {
+		store := &rqliteStore{caseInsensitiveUsers: caseInsensitive}
+		if store.userColumn() != expected[0] || store.userParameter() != expected[1] {
+			t.Errorf(
+				"Expected %v with case-insensitive users %t, got [%s %s]",
+				expected, caseInsensitive, store.userColumn(), store.userParameter())
+		}
+	}
+}
+
+// ---
+// Fake rqlite server recording statements of requests, which have no results.
+type recordingRqlite struct {
+	statements []string
+}
+
+// ---
+func (database *recordingRqlite) ServeHTTP(
+	response http.ResponseWriter, request *http.Request) {
+
+	body, _ := io.ReadAll(request.Body)
+	database.statements = append(database.statements, string(body))
+	response.Write([]byte(`{"results":[{"columns":[],"types":[],"values":[]}]}`))
+}
+
+// ---
+func TestUserQueriesNormalizeUsersIfCaseInsensitive(t *testing.T) {
+	queries := map[string]func(store *rqliteStore) error{
+		"active users": func(store *rqliteStore) error {
+			_, err := store.ActiveUsers(context.Background(), time.Now())
+			return err
+		},
+		"user activity": func(store *rqliteStore) error {
+			_, err := store.UserActivity(context.Background(), pagination{Limit: 10, After: "Ada"})
+			return err
+		},
+		"common favorites": func(store *rqliteStore) error {
+			_, err := store.CommonFavorites(context.Background(), []string{"Ada", "bob"})
+			return err
+		},
+	}
+
+	for name, query := range queries {
+		t.Run(name, func(t *testing.T) {
+			database := &recordingRqlite{}
+			store := newFakeRqliteStore(t, database)
+			store.caseInsensitiveUsers = true
+
+			if err := query(store); err != nil {
+				t.Fatalf("Query failed: %s", err)
+			}
+
+			statement := database.statements[len(database.statements) - 1]
+			if !strings.Contains(statement, "LOWER(user)") ||
+				(name != "active users" && !strings.Contains(statement, "LOWER(?)")) {
+
+				t.Errorf("Expected users to be normalized by database, got %s", statement)
+			}
+		})
+	}
+}
+
+// ---
+// Fake rqlite server for migrations, reporting a table without migrated columns
+// and failing additions of columns with alterError.
+type fakeMigrationRqlite struct {
+	alterError string
+	indexes int
+}
+
+// ---
+func (database *fakeMigrationRqlite) ServeHTTP(
+	response http.ResponseWriter, request *http.Request) {
+
+	body, _ := io.ReadAll(request.Body)
+	switch {
+	case request.URL.Path == "/db/query":
+		response.Write([]byte(`{"results":[{
+			"columns":["name","type","notnull","dflt_value","pk"],
+			"types":["text","text","integer","text","integer"],
+			"values":[["id","INTEGER",0,null,1],["user","TEXT",0,null,0]]}]}`))
+	case bytes.Contains(body, []byte("ADD COLUMN")):
+		response.Write([]byte(`{"results":[{"error":"` + database.alterError + `"}]}`))
+	default:
+		database.indexes++
+		response.Write([]byte(fakeWriteResult))
+	}
+}
+
+// ---
+func TestMigrationSkipsConcurrentlyAddedColumns(t *testing.T) {
+	database := &fakeMigrationRqlite{alterError: "duplicate column name: category"}
+	if err := newFakeRqliteStore(t, database).Migrate(context.Background()); err != nil {
+		t.Fatalf("Expected concurrently added columns to be skipped, got error: %s", err)
+	}
+
+	if database.indexes != len(migrationIndexes) {
+		t.Errorf(
+			"Expected %d indexes to be created, got %d", len(migrationIndexes), database.indexes)
+	}
+
+	database = &fakeMigrationRqlite{alterError: "disk I/O error"}
+	if err := newFakeRqliteStore(t, database).Migrate(context.Background()); err == nil {
+		t.Errorf("Expected other errors adding columns to fail migration")
+	}
+}
+
+// ---
+func TestListingRecordsConsistencyOfReadConnection(t *testing.T) {
+	cases := []struct {
+		name string
+		replicaStatus int
+		consistency string
+	}{
+		{"replica", http.StatusOK, "none"},
+		{"unavailable replica", http.StatusServiceUnavailable, "strong"},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			store := newFakeRqliteStore(t, &fakeRqlite{statuses: []int{200}})
+			replica := newFakeRqliteStore(t, &fakeRqlite{statuses: []int{testCase.replicaStatus}})
+			store.readConnection = replica.connection
+
+			ctx, consistency := withConsistencyRecorder(context.Background())
+			favorites, err := store.ListFavorites(ctx, "ada", favoritesFilter{})
+			if err != nil || len(favorites) != 1 {
+				t.Fatalf("Expected one favorite, got %v and error: %v", favorites, err)
+			}
+
+			if *consistency != testCase.consistency {
+				t.Errorf(
+					"Expected consistency \"%s\", got \"%s\"", testCase.consistency, *consistency)
+			}
+		})
+	}
+}
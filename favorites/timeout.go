@@ -0,0 +1,47 @@
+// Middleware enforcing an overall deadline for handling of requests.
+
+package main
+
+import (
+	"time"
+	"net/http"
+)
+
+// ---
+// Wraps response writer to explicitly set sniffed content type upon first write
+// if the handler didn't set it, as the header set by withRequestTimeout is
+// otherwise used for successful responses.
+type contentTypeSniffer struct {
+	http.ResponseWriter
+}
+
+// ---
+func (sniffer *contentTypeSniffer) Write(data []byte) (int, error) {
+	if sniffer.Header().Get("Content-Type") == "" {
+		sniffer.Header().Set("Content-Type", http.DetectContentType(data))
+	}
+
+	return sniffer.ResponseWriter.Write(data)
+}
+
+// ---
+func (sniffer *contentTypeSniffer) Unwrap() http.ResponseWriter {
+	return sniffer.ResponseWriter
+}
+
+// ---
+// Returns handler responding with 503 and a JSON error if handler doesn't finish
+// within timeout. The request context is canceled upon timeout, which aborts
+// any ongoing database calls as well.
+func withRequestTimeout(handler http.Handler, timeout time.Duration) http.Handler {
+	timeoutHandler := http.TimeoutHandler(
+		http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			handler.ServeHTTP(&contentTypeSniffer{response}, request)
+		}),
+		timeout, `{"code":"` + errorRequestTimeout.name + `","error":"Request timed out"}`)
+
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Set("Content-Type", "application/json")
+		timeoutHandler.ServeHTTP(response, request)
+	})
+}
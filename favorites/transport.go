@@ -0,0 +1,37 @@
+// HTTP client used for connections to rqlite.
+
+package main
+
+import (
+	"net/http"
+	"github.com/rqlite/gorqlite"
+)
+
+// ---
+// Adds headers (such as authentication for proxies) to every request.
+type headerTransport struct {
+	headers http.Header
+	base http.RoundTripper
+}
+
+// ---
+func (transport *headerTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	request = request.Clone(request.Context())
+	for name, values := range transport.headers {
+		request.Header[name] = values
+	}
+
+	return transport.base.RoundTrip(request)
+}
+
+// ---
+// Returns client for database connections, which adds headers if any are specified.
+func newDatabaseClient(headers http.Header) *http.Client {
+	if len(headers) == 0 {
+		return gorqlite.DefaultHTTPClient
+	}
+
+	return &http.Client{
+		Timeout: gorqlite.DefaultHTTPClient.Timeout,
+		Transport: &headerTransport{headers: headers, base: http.DefaultTransport}}
+}
@@ -0,0 +1,64 @@
+// Best-effort in-memory tracking of the last undoable action per user. History
+// is not shared between replicas and is lost upon restart.
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type undoAction struct {
+	kind string
+	id int64
+	drink string
+	recorded time.Time
+}
+
+type undoHistory struct {
+	mutex sync.Mutex
+	maxUsers int
+	actions map[string]undoAction
+}
+
+// ---
+func newUndoHistory(maxUsers int) *undoHistory {
+	return &undoHistory{maxUsers: maxUsers, actions: map[string]undoAction{}}
+}
+
+// ---
+// Records action as the last one for user, evicting the least recently
+// recorded action of another user if history is full.
+func (history *undoHistory) Record(user string, action undoAction) {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+
+	_, exists := history.actions[user]
+	if !exists && len(history.actions) >= history.maxUsers {
+		var oldestUser string
+		var oldestRecorded time.Time
+
+		for actionUser, existingAction := range history.actions {
+			if oldestUser == "" || existingAction.recorded.Before(oldestRecorded) {
+				oldestUser = actionUser
+				oldestRecorded = existingAction.recorded
+			}
+		}
+
+		delete(history.actions, oldestUser)
+	}
+
+	action.recorded = time.Now()
+	history.actions[user] = action
+}
+
+// ---
+// Removes and returns the last action recorded for user, if any.
+func (history *undoHistory) Pop(user string) (undoAction, bool) {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+
+	action, exists := history.actions[user]
+	delete(history.actions, user)
+	return action, exists
+}
@@ -0,0 +1,68 @@
+// Validation of submitted favorites against a JSON Schema, which reports all
+// problems found instead of only the first.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"encoding/json"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// Either a JSON string containing the drink name or an object with drink,
+// optional category (see validateCategory for restrictions), optional
+// timestamp (parsed by parseFavoriteSubmission) and optional client-generated
+// UUID making submission idempotent.
+var favoriteSubmissionSchema = jsonschema.MustCompileString("favorite_submission.json", `{
+	"type": ["string", "object"],
+	"minLength": 1,
+	"required": ["drink"],
+	"properties": {
+		"drink": {"type": "string", "minLength": 1},
+		"timestamp": {"type": "string", "minLength": 1},
+		"clientId": {
+			"type": "string",
+			"pattern": "^[0-9a-fA-F]{8}(-[0-9a-fA-F]{4}){3}-[0-9a-fA-F]{12}$"},
+		"category": {
+			"type": ["string", "null"],
+			"maxLength": 64,
+			"pattern": "^[\\p{L}\\p{Nd} _-]*$"}}}`)
+
+// ---
+type validationProblem struct {
+	Field string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ---
+// Returns problems found by validating body of favorite addition request, which
+// is empty if body is valid. Returns error if body isn't JSON.
+func validateFavoriteSubmission(requestBody []byte) ([]validationProblem, error) {
+	decoder := json.NewDecoder(bytes.NewReader(requestBody))
+	decoder.UseNumber()
+
+	var document interface{}
+	if err := decoder.Decode(&document); err != nil {
+		return nil, err
+	}
+
+	err := favoriteSubmissionSchema.Validate(document)
+	validationError, isValidationError := err.(*jsonschema.ValidationError)
+	if !isValidationError {
+		return nil, err
+	}
+
+	problems := []validationProblem{}
+	for _, basicError := range validationError.BasicOutput().Errors {
+		// Errors wrapping other errors (such as "doesn't validate with ...") are skipped
+		if strings.HasPrefix(basicError.Error, "doesn't validate with") {
+			continue
+		}
+
+		field := strings.TrimPrefix(basicError.InstanceLocation, "/")
+		problems = append(problems, validationProblem{Field: field, Message: basicError.Error})
+	}
+
+	return problems, nil
+}